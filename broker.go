@@ -17,21 +17,32 @@
 package stomp
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/gmallard/stompngo"
 	"github.com/satori/go.uuid"
+	"io"
 	"net"
-	"os"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type (
 	// ConnectionParameters store the configuration for the Stomp connection
 	ConnectionParameters struct {
-		// Address is Host:Port
+		// Address is Host:Port, a WebSocket URL (ws://host/path or wss://host/path),
+		// a DNS SRV record name (_stomp._tcp.example.com), or a failover URI, as
+		// failover:(stomp://a:61613,wss://b/stomp)?randomize=false&maxReconnectAttempts=10
 		Address string
+		// STOMP virtual host, sent as the host header to every broker, regardless
+		// of the address dialed. If empty, the host name of the address is used
+		// (the alias for consumers, not the resolved IPs).
+		VirtualHost string
 		// Authentication
 		Login, Passcode string
 		// For SSL/TLS
@@ -39,53 +50,294 @@ type (
 		Insecure          bool
 		CaPath, CaCert    string
 		UserCert, UserKey string
+		// Name used to verify the certificate of brokers reached via a resolved IP
+		ServerNameMode ServerNameMode
+		// Address family tried first when a broker behind the consumer alias has
+		// both IPv4 and IPv6 addresses
+		IPPreference IPPreference
+		// How long to wait for the preferred address before racing the next one.
+		// 0 uses DefaultFallbackDelay, and a negative value tries them one after the other.
+		FallbackDelay time.Duration
+		// How often a consumer resolves the alias again, to connect to new brokers and
+		// drop the retired ones. 0 disables it.
+		ResolveInterval time.Duration
+		// How many brokers behind the consumer alias must be reachable for NewConsumer
+		// to succeed. The others are retried in the background, following ReconnectPolicy,
+		// and join the subscriptions once connected. 0 requires all of them.
+		MinBrokers int
+		// How a producer spreads the messages between the brokers behind the alias
+		Balancing Balancing
+		// Opens the network connections. If nil, a plain net.Dialer is used.
+		Dialer Dialer
+		// Proxy URL (socks5://, http:// or https://) to tunnel the connections through.
+		// If empty, ALL_PROXY and HTTPS_PROXY are honoured. ProxyDirect disables the proxy.
+		Proxy string
 		// Callback when a connection is lost
+		// If ReconnectPolicy is nil, the callback is responsible for reconnecting.
+		// Otherwise, it is only a notification, and the reconnection is automatic.
 		ConnectionLost ConnectionLostCallback
-		// Client identification
+		// How to reconnect when the connection is lost
+		ReconnectPolicy *ReconnectPolicy
+		// Client identification. A random suffix is added, unless Durable is set.
 		ClientID string
+		// Durable keeps ClientID as is, so the brokers recognise the consumer across
+		// restarts, as durable subscriptions need. ClientID must then be unique to
+		// this consumer. Ignored by producers.
+		Durable bool
+		// Dialect of the brokers, for the headers of durable subscriptions.
+		// Detected from the CONNECTED frame if not set.
+		Dialect Dialect
+		// STOMP protocol versions to accept, in order of preference.
+		// If empty, DefaultAcceptVersions is used.
+		AcceptVersions []string
+		// How often the client sends heart-beats to the broker. 0 disables them.
+		ClientHeartBeat time.Duration
+		// How often the broker is asked to send heart-beats. 0 disables them.
+		// If the broker heart-beats stop arriving, the connection is considered lost.
+		ServerHeartBeat time.Duration
+		// Ask the broker for a receipt of every SEND, ACK and NACK, and wait for it,
+		// so an ERROR frame caused by them is returned by the failing call
+		Receipts bool
 
 		caCertPool  *x509.CertPool
 		clientCerts []tls.Certificate
+		// Shared by all brokers of a Consumer
+		events chan Event
 	}
 
 	// Broker wraps the underlying network and stomp connection, so reconnects can be done
-	// transparently
+	// transparently. It is safe for concurrent use.
 	Broker struct {
-		params          ConnectionParameters
+		params   ConnectionParameters
+		failover *failover
+		events   chan Event
+		// Identifies the broker behind a consumer alias
+		target string
+		// Background recoveries run under ctx, which is cancelled when the broker is closed
+		ctx    context.Context
+		cancel context.CancelFunc
+		// Closed when the consumer stops taking messages from this broker
+		draining chan struct{}
+
+		// Serializes connection attempts
+		connectMu sync.Mutex
+
+		// mu protects the fields below
+		mu              sync.RWMutex
+		endpoint        endpoint
 		netConnection   net.Conn
 		stompConnection *stompngo.Connection
-		host            string
+		heartBeatStop   chan struct{}
+		dispatcher      *dispatcher
+		// Incremented on every successful connection
+		generation uint64
+		// Set while the connection lost path is running
+		recovering *recovery
+		closed     bool
+		// Replayed after every connection, by subscription id
+		subscriptions map[string]*brokerSubscription
+
+		// listenersMu protects listeners
+		listenersMu sync.Mutex
+		// Subscriptions to notify of ERROR frames, by subscription id
+		listeners map[string]func(error)
+	}
+
+	// connection is an established connection to one of the endpoints
+	connection struct {
+		endpoint endpoint
+		net      net.Conn
+		stomp    *stompngo.Connection
+		liveness *livenessConn
+	}
+
+	// recovery tracks an ongoing recovery from a lost connection, so concurrent callers
+	// wait for it instead of triggering their own
+	recovery struct {
+		done chan struct{}
+		err  error
 	}
 
 	// ConnectionLostCallback is the callback type for lost connections
 	ConnectionLostCallback func(c *Broker)
+
+	// ServerNameMode selects the name expected on the broker certificate, and sent as SNI,
+	// when the consumer dials the IPs behind an alias
+	ServerNameMode int
+)
+
+const (
+	// ServerNameAlias verifies against the alias from the address
+	ServerNameAlias = ServerNameMode(iota)
+	// ServerNameReverseDNS verifies against the reverse DNS name of each IP, as long as
+	// that name resolves back to the IP, falling back to the alias otherwise
+	ServerNameReverseDNS
+	// ServerNameIP verifies against the IP itself
+	ServerNameIP
 )
 
+// String implements fmt.Stringer
+func (m ServerNameMode) String() string {
+	switch m {
+	case ServerNameAlias:
+		return "alias"
+	case ServerNameReverseDNS:
+		return "reverse"
+	case ServerNameIP:
+		return "ip"
+	}
+	return "unknown"
+}
+
+// ParseServerNameMode parses the string representation of a ServerNameMode
+func ParseServerNameMode(s string) (ServerNameMode, error) {
+	switch s {
+	case "alias":
+		return ServerNameAlias, nil
+	case "reverse":
+		return ServerNameReverseDNS, nil
+	case "ip":
+		return ServerNameIP, nil
+	}
+	return ServerNameAlias, fmt.Errorf("stomp: invalid server name mode %s", s)
+}
+
+// DefaultAcceptVersions are the protocol versions negotiated if none are configured
+var DefaultAcceptVersions = []string{stompngo.SPL_12, stompngo.SPL_11, stompngo.SPL_10}
+
 // RemoteAddr returns the broker network address
 func (c *Broker) RemoteAddr() net.Addr {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.netConnection.RemoteAddr()
 }
 
+// ProtocolVersion returns the STOMP protocol version negotiated with the broker
+func (c *Broker) ProtocolVersion() string {
+	conn, _ := c.current()
+	return conn.Protocol()
+}
+
+// current returns the current stomp connection, and its generation
+func (c *Broker) current() (*stompngo.Connection, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stompConnection, c.generation
+}
+
+// available returns true if the broker is connected, and not recovering a lost connection
+func (c *Broker) available() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.closed && c.recovering == nil && c.stompConnection != nil && c.stompConnection.Connected()
+}
+
 // Reconnect triggers a new connection
 func (c *Broker) Reconnect() error {
+	return c.ReconnectContext(context.Background())
+}
+
+// ReconnectContext triggers a new connection, giving up if ctx is done before
+// the connection is established
+func (c *Broker) ReconnectContext(ctx context.Context) error {
+	c.emit(EventConnecting, nil)
+	if err := c.reconnect(ctx); err != nil {
+		return err
+	}
+	c.emit(EventConnected, nil)
+	c.resubscribe()
+	return nil
+}
+
+// reconnect closes the existing connection, if any, and opens a new one,
+// trying all the endpoints
+func (c *Broker) reconnect(ctx context.Context) (err error) {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	c.stopHeartBeats()
+	c.stopDispatcher()
 	if c.netConnection != nil {
 		c.netConnection.Close()
+		// Whoever notices the old connection is gone does not need to recover it
+		c.generation++
 	}
+	c.mu.Unlock()
 
-	var err error
-	if c.params.EnableTLS {
-		err = c.connectTLS()
-	} else {
-		err = c.connect()
+	endpoints, err := c.failover.order(ctx)
+	if err != nil {
+		return err
 	}
 
+	var conn *connection
+	if c.failover.fallbackDelay > 0 && len(endpoints) > 1 {
+		// Only the winner gets a CONNECT, so the broker never sees the client id twice
+		var ep endpoint
+		var netConnection net.Conn
+		if ep, netConnection, err = c.dialHappyEyeballs(ctx, endpoints, c.failover.fallbackDelay); err == nil {
+			conn, err = c.stompHandshake(ctx, ep, netConnection)
+		}
+	} else {
+		for _, ep := range endpoints {
+			if conn, err = c.open(ctx, ep); err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+	}
 	if err != nil {
 		return err
 	}
+	return c.install(conn)
+}
+
+// open connects to the given endpoint, without replacing the current connection
+func (c *Broker) open(ctx context.Context, ep endpoint) (*connection, error) {
+	netConnection, err := c.dialEndpoint(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	return c.stompHandshake(ctx, ep, netConnection)
+}
+
+// dialEndpoint opens the network connection to the given endpoint, including the TLS
+// and WebSocket handshakes
+func (c *Broker) dialEndpoint(ctx context.Context, ep endpoint) (net.Conn, error) {
+	if ep.websocket {
+		return c.connectWebSocket(ctx, ep)
+	} else if ep.tls {
+		return c.connectTLS(ctx, ep)
+	}
+	return c.connect(ctx, ep)
+}
+
+// stompHandshake sends CONNECT through netConnection, which is closed on failure
+func (c *Broker) stompHandshake(ctx context.Context, ep endpoint, netConnection net.Conn) (*connection, error) {
+
+	// Keep track of the incoming traffic if we expect heart-beats
+	var liveness *livenessConn
+	if c.params.ServerHeartBeat > 0 {
+		liveness = newLivenessConn(netConnection)
+		netConnection = liveness
+	}
+
+	acceptVersions := c.params.AcceptVersions
+	if len(acceptVersions) == 0 {
+		acceptVersions = DefaultAcceptVersions
+	}
+
+	vhost := c.params.VirtualHost
+	if vhost == "" {
+		vhost = ep.vhost
+	}
 
 	headers := stompngo.Headers{
-		"accept-version", "1.1", // https://github.com/gmallard/stompngo/issues/13
-		"host", c.host,
+		"accept-version", strings.Join(acceptVersions, ","),
+		"host", vhost,
 		"client-id", c.params.ClientID,
 	}
 	if c.params.Login != "" {
@@ -94,26 +346,104 @@ func (c *Broker) Reconnect() error {
 	if c.params.Passcode != "" {
 		headers = headers.Add("passcode", c.params.Passcode)
 	}
+	if c.params.ClientHeartBeat > 0 || c.params.ServerHeartBeat > 0 {
+		headers = headers.Add("heart-beat", c.params.heartBeatHeader())
+	}
 
-	if c.stompConnection, err = stompngo.Connect(c.netConnection, headers); err != nil {
+	stompConnection, err := stompConnect(ctx, netConnection, headers)
+	if err != nil {
+		netConnection.Close()
 		if err == stompngo.ECONERR {
-			return errors.New(c.stompConnection.ConnectResponse.BodyString())
+			return nil, newConnectError(stompConnection.ConnectResponse)
+		}
+		return nil, err
+	}
+
+	return &connection{
+		endpoint: ep,
+		net:      netConnection,
+		stomp:    stompConnection,
+		liveness: liveness,
+	}, nil
+}
+
+// install replaces the current connection
+func (c *Broker) install(conn *connection) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		// Closed while connecting
+		conn.close()
+		return ErrNotConnected
+	}
+	c.endpoint = conn.endpoint
+	c.netConnection = conn.net
+	c.stompConnection = conn.stomp
+	c.generation++
+	c.dispatcher = newDispatcher()
+	go c.watchFrames(conn.stomp, c.dispatcher, c.generation)
+
+	if conn.liveness != nil {
+		connected := conn.stomp.ConnectResponse.Headers.Value("heart-beat")
+		if interval := c.params.negotiateHeartBeat(connected); interval > 0 {
+			c.heartBeatStop = make(chan struct{})
+			go c.watchHeartBeats(conn.liveness, interval, c.heartBeatStop)
 		}
-		return err
 	}
 	return nil
 }
 
+// close releases a connection that has not been installed
+func (conn *connection) close() {
+	conn.stomp.Disconnect(stompngo.Headers{})
+	conn.net.Close()
+}
+
+// stopHeartBeats stops watching the broker heart-beats, if running.
+// Must be called with mu held.
+func (c *Broker) stopHeartBeats() {
+	if c.heartBeatStop != nil {
+		close(c.heartBeatStop)
+		c.heartBeatStop = nil
+	}
+}
+
+// stompConnect sends the CONNECT frame, and waits for the answer unless ctx is done first
+func stompConnect(ctx context.Context, conn net.Conn, headers stompngo.Headers) (stompConnection *stompngo.Connection, err error) {
+	err = handshake(ctx, conn, func() (err error) {
+		stompConnection, err = stompngo.Connect(conn, headers)
+		return
+	})
+	return
+}
+
 // dial connects to a Stomp broker. Internal use.
-func dial(params ConnectionParameters) (c *Broker, err error) {
-	params.ClientID += "-" + uuid.NewV4().String()
+func dial(ctx context.Context, params ConnectionParameters) (*Broker, error) {
+	f, err := parseAddress(&params)
+	if err != nil {
+		return nil, err
+	}
+	return dialEndpoints(ctx, params, f)
+}
+
+// dialEndpoints connects to a Stomp broker reachable via any of the given endpoints.
+// Internal use.
+func dialEndpoints(ctx context.Context, params ConnectionParameters, f *failover) (c *Broker, err error) {
+	if !params.Durable {
+		params.ClientID += "-" + uuid.NewV4().String()
+	}
 	aux := &Broker{
-		params: params,
+		params:   params,
+		failover: f,
+		events:   make(chan Event, eventBufferSize),
+		draining: make(chan struct{}),
 	}
-	if aux.host, _, err = net.SplitHostPort(params.Address); err != nil {
-		return
+	aux.ctx, aux.cancel = context.WithCancel(context.Background())
+	if len(f.endpoints) > 0 {
+		aux.endpoint = f.endpoints[0]
 	}
-	if err = aux.Reconnect(); err != nil {
+	if err = aux.ReconnectContext(ctx); err != nil {
+		aux.cancel()
 		return
 	}
 	c = aux
@@ -122,31 +452,79 @@ func dial(params ConnectionParameters) (c *Broker, err error) {
 
 // close closes the connections and frees the resources
 func (c *Broker) close() error {
-	c.stompConnection.Disconnect(stompngo.Headers{})
-	return c.netConnection.Close()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.cancel()
+	c.stopHeartBeats()
+	c.stopDispatcher()
+	c.forgetAll()
+	netConnection, stompConnection := c.netConnection, c.stompConnection
+	c.mu.Unlock()
+
+	// Writing DISCONNECT may block, and must not block the readers of the broker state
+	stompConnection.Disconnect(stompngo.Headers{})
+	err := netConnection.Close()
+
+	c.emit(EventDisconnected, nil)
+	return err
+}
+
+// address returns the address of the current endpoint
+func (c *Broker) address() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.endpoint.address
 }
 
-// Reconnect loop
-func (c *Broker) handleReconnectOnSend(err error) error {
+// Reconnect loop. gen is the generation of the connection that produced err.
+func (c *Broker) handleReconnectOnSend(ctx context.Context, gen uint64, err error) error {
 	if err == nil {
 		// Success
 		return nil
-	} else if c.params.ConnectionLost == nil {
-		// No callback, so do not even bother
-		return err
-	} else if err == stompngo.ECONBAD {
-		// Probably a previous reconnect failed
-		c.params.ConnectionLost(c)
-		return syscall.EAGAIN
-	} else if netErr, ok := err.(*net.OpError); ok {
-		// Network error, let's see if it is a disconnect one
-		if sysErr, ok := netErr.Err.(*os.SyscallError); ok {
-			if sysErr.Err == syscall.EPIPE {
-				c.params.ConnectionLost(c)
-				return syscall.EAGAIN
-			}
+	} else if !c.canReconnect() {
+		// No way of recovering, so do not even bother
+		return lostConnectionError(err)
+	} else if isConnectionLost(err) {
+		if err = c.connectionLost(ctx, gen, err); err != nil {
+			return err
 		}
+		return errRetry
 	}
 	// An error that is not recoverable
 	return err
 }
+
+// isConnectionLost returns true if the error means the connection is gone
+func isConnectionLost(err error) bool {
+	switch {
+	case err == stompngo.ECONBAD:
+		// Probably a previous reconnect failed
+		return true
+	case err == io.EOF, err == io.ErrUnexpectedEOF:
+		return true
+	case errors.Is(err, net.ErrClosed):
+		// Closed locally, i.e. the broker stopped sending heart-beats
+		return true
+	case errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+	return false
+}
+
+// retry runs op on the current connection until it succeeds, fails with an unrecoverable
+// error, or ctx is done. Lost connections are recovered between attempts.
+func (c *Broker) retry(ctx context.Context, op func(*stompngo.Connection) error) (err error) {
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		conn, gen := c.current()
+		if err = c.handleReconnectOnSend(ctx, gen, op(conn)); err != errRetry {
+			return
+		}
+	}
+}
@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/gmallard/stompngo"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// standInTimeout is how long the tests wait for something to happen
+const standInTimeout = 5 * time.Second
+
+type (
+	// stompStandIn plays a STOMP broker on the connections it accepts. It answers CONNECT,
+	// the receipts, and closes the connection after DISCONNECT.
+	stompStandIn struct {
+		t        *testing.T
+		listener net.Listener
+		// Version sent in CONNECTED, 1.2 if empty
+		version string
+		// Other headers of the CONNECTED frame
+		connected stompngo.Headers
+		// Called with each frame received before the default answer, which is skipped
+		// if it returns false. Set before the first connection.
+		handle func(session *standInSession, frame stompngo.Message) bool
+
+		// Every frame received, CONNECT included
+		frames chan stompngo.Message
+		// Every session, once CONNECTED is sent
+		sessions chan *standInSession
+
+		mu    sync.Mutex
+		conns []net.Conn
+	}
+
+	// standInSession is a connection accepted by the stand-in
+	standInSession struct {
+		conn     net.Conn
+		writeMu  sync.Mutex
+		messages int64
+	}
+)
+
+// newStompStandIn listens on the loopback interface. The test is skipped if that is
+// not possible.
+func newStompStandIn(t *testing.T) *stompStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	s := &stompStandIn{
+		t:        t,
+		listener: listener,
+		frames:   make(chan stompngo.Message, 1024),
+		sessions: make(chan *standInSession, 64),
+	}
+	t.Cleanup(s.close)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// close stops listening, and closes all the connections
+func (s *stompStandIn) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// address returns the address the stand-in listens on
+func (s *stompStandIn) address() string {
+	return s.listener.Addr().String()
+}
+
+// serve plays the broker on conn until it is closed
+func (s *stompStandIn) serve(conn net.Conn) {
+	session := &standInSession{conn: conn}
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := readStandInFrame(reader)
+		if err != nil {
+			conn.Close()
+			return
+		} else if frame.Command == "" {
+			// Heart-beat
+			continue
+		}
+		s.frames <- frame
+		if s.handle != nil && !s.handle(session, frame) {
+			continue
+		}
+
+		switch frame.Command {
+		case "CONNECT", "STOMP":
+			version := s.version
+			if version == "" {
+				version = stompngo.SPL_12
+			}
+			headers := stompngo.Headers{"version", version, "session", fmt.Sprint(time.Now().UnixNano())}
+			session.send("CONNECTED", headers.AddHeaders(s.connected), "")
+			select {
+			case s.sessions <- session:
+			default:
+			}
+			continue
+		}
+		if receipt := frame.Headers.Value("receipt"); receipt != "" {
+			session.send("RECEIPT", stompngo.Headers{"receipt-id", receipt}, "")
+		}
+		if frame.Command == "DISCONNECT" {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// expect waits for a frame with the given command, skipping the others
+func (s *stompStandIn) expect(command string) stompngo.Message {
+	s.t.Helper()
+	timeout := time.After(standInTimeout)
+	for {
+		select {
+		case frame := <-s.frames:
+			if frame.Command == command {
+				return frame
+			}
+		case <-timeout:
+			s.t.Fatalf("no %s received", command)
+		}
+	}
+}
+
+// session waits for the next connection to be established
+func (s *stompStandIn) session() *standInSession {
+	s.t.Helper()
+	select {
+	case session := <-s.sessions:
+		return session
+	case <-time.After(standInTimeout):
+		s.t.Fatal("no connection received")
+	}
+	return nil
+}
+
+// send writes a frame to the client
+func (session *standInSession) send(command string, headers stompngo.Headers, body string) error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	var frame strings.Builder
+	frame.WriteString(command + "\n")
+	for i := 0; i+1 < len(headers); i += 2 {
+		frame.WriteString(headers[i] + ":" + headers[i+1] + "\n")
+	}
+	frame.WriteString("content-length:" + strconv.Itoa(len(body)) + "\n\n")
+	frame.WriteString(body + "\x00")
+	_, err := io.WriteString(session.conn, frame.String())
+	return err
+}
+
+// message sends a MESSAGE for the subscription id
+func (session *standInSession) message(id, body string) error {
+	n := fmt.Sprint(atomic.AddInt64(&session.messages, 1))
+	return session.send("MESSAGE", stompngo.Headers{
+		"subscription", id,
+		"message-id", n,
+		"ack", n,
+		"destination", "/queue/test",
+	}, body)
+}
+
+// drop closes the connection without a word
+func (session *standInSession) drop() {
+	session.conn.Close()
+}
+
+// readStandInFrame reads a frame. Heart-beats are returned as frames without command.
+func readStandInFrame(reader *bufio.Reader) (stompngo.Message, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return stompngo.Message{}, err
+	}
+	frame := stompngo.Message{Command: strings.TrimRight(line, "\r\n")}
+	if frame.Command == "" {
+		return frame, nil
+	}
+	for {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return frame, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i >= 0 {
+			frame.Headers = frame.Headers.Add(line[:i], line[i+1:])
+		}
+	}
+	body, err := reader.ReadBytes(0)
+	if err != nil {
+		return frame, err
+	}
+	frame.Body = body[:len(body)-1]
+	return frame, nil
+}
+
+// dialStandIn connects a broker to the stand-in, closing it at the end of the test
+func dialStandIn(t *testing.T, s *stompStandIn, params ConnectionParameters) *Broker {
+	t.Helper()
+	params.Address = s.address()
+	ctx, cancel := context.WithTimeout(context.Background(), standInTimeout)
+	defer cancel()
+	broker, err := dial(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.close() })
+	return broker
+}
+
+// stallingConn blocks the writes while stalled, until released
+type stallingConn struct {
+	net.Conn
+	stalled int32
+	// Closed once a write is blocked
+	blocked chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+// Write implements net.Conn
+func (s *stallingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&s.stalled) != 0 {
+		s.once.Do(func() { close(s.blocked) })
+		<-s.release
+	}
+	return s.Conn.Write(b)
+}
+
+func TestBrokerCloseDoesNotBlockReaders(t *testing.T) {
+	s := newStompStandIn(t)
+	conn := &stallingConn{blocked: make(chan struct{}), release: make(chan struct{})}
+	broker := dialStandIn(t, s, ConnectionParameters{
+		Dialer: DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			var err error
+			conn.Conn, err = (&net.Dialer{}).DialContext(ctx, network, address)
+			return conn, err
+		}),
+	})
+
+	atomic.StoreInt32(&conn.stalled, 1)
+	closed := make(chan struct{})
+	go func() {
+		broker.close()
+		close(closed)
+	}()
+
+	// DISCONNECT is stuck, but the state of the broker can still be read
+	select {
+	case <-conn.blocked:
+	case <-time.After(standInTimeout):
+		t.Fatal("DISCONNECT not sent")
+	}
+	read := make(chan struct{})
+	go func() {
+		broker.available()
+		broker.RemoteAddr()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(standInTimeout):
+		t.Fatal("close holds the broker lock while writing")
+	}
+
+	close(conn.release)
+	select {
+	case <-closed:
+	case <-time.After(standInTimeout):
+		t.Fatal("close did not finish")
+	}
+}
+
+func TestBrokerConcurrentReconnect(t *testing.T) {
+	s := newStompStandIn(t)
+	broker := dialStandIn(t, s, ConnectionParameters{})
+	s.session()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := broker.Reconnect(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			broker.ProtocolVersion()
+			broker.available()
+		}()
+	}
+	wg.Wait()
+
+	if !broker.available() {
+		t.Error("expected the broker to be connected")
+	}
+}
@@ -76,3 +76,28 @@ func loadClientCert(ucert, ukey string) ([]tls.Certificate, error) {
 	}
 	return []tls.Certificate{cert}, nil
 }
+
+// loadCredentials loads the CA and client certificates if any endpoint uses TLS
+func (p *ConnectionParameters) loadCredentials() (err error) {
+	if !p.usesTLS() {
+		return nil
+	}
+	p.caCertPool = loadRootCAs(p.CaPath, p.CaCert)
+	p.clientCerts, err = loadClientCert(p.UserCert, p.UserKey)
+	return
+}
+
+// usesTLS returns true if any of the endpoints is to be reached via TLS
+func (p ConnectionParameters) usesTLS() bool {
+	if p.EnableTLS {
+		return true
+	}
+	if f, err := parseAddress(&p); err == nil {
+		for _, ep := range f.endpoints {
+			if ep.tls {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -17,34 +17,112 @@
 package stomp
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"time"
 )
 
+type (
+	// Dialer opens the network connection to a broker. *net.Dialer satisfies this interface.
+	// It is used for both plain and TLS connections, the TLS handshake being done on top
+	// of the returned connection.
+	Dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}
+
+	// DialerFunc adapts a function into a Dialer
+	DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+)
+
+// DialContext implements Dialer
+func (f DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// defaultDialer is used when the parameters do not specify one
+var defaultDialer Dialer = &net.Dialer{}
+
+// dialer returns the dialer to use to reach address: the configured one, or the
+// default one, wrapped by a proxy if needed
+func (c *Broker) dialer(address string) (Dialer, error) {
+	dialer := c.params.Dialer
+	if dialer == nil {
+		dialer = defaultDialer
+	}
+	proxy, err := c.params.proxyFor(address)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		dialer = &proxyDialer{proxy: proxy, forward: dialer}
+	}
+	return dialer, nil
+}
+
+// dialTCP opens the network connection to the endpoint
+func (c *Broker) dialTCP(ctx context.Context, ep endpoint) (net.Conn, error) {
+	dialer, err := c.dialer(ep.address)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, "tcp", ep.address)
+}
+
 // Connect to a plain socket
-func (c *Broker) connect() (err error) {
-	c.netConnection, err = net.Dial("tcp", c.params.Address)
-	return
+func (c *Broker) connect(ctx context.Context, ep endpoint) (net.Conn, error) {
+	return c.dialTCP(ctx, ep)
 }
 
 // Connect via TLS
-func (c *Broker) connectTLS() error {
-	rawConnection, err := net.Dial("tcp", c.params.Address)
+func (c *Broker) connectTLS(ctx context.Context, ep endpoint) (net.Conn, error) {
+	rawConnection, err := c.dialTCP(ctx, ep)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	tlsConnection := tls.Client(rawConnection, c.tlsConfig(ep))
+	if err = tlsConnection.HandshakeContext(ctx); err != nil {
+		rawConnection.Close()
+		return nil, err
 	}
+	return tlsConnection, nil
+}
 
-	config := &tls.Config{
+// tlsConfig returns the TLS configuration to connect to the endpoint
+func (c *Broker) tlsConfig(ep endpoint) *tls.Config {
+	return &tls.Config{
 		Certificates:       c.params.clientCerts,
 		RootCAs:            c.params.caCertPool,
-		ServerName:         c.host,
+		ServerName:         ep.host,
 		InsecureSkipVerify: c.params.Insecure,
 	}
+}
+
+// handshake runs fn, which talks over conn, unblocking it if ctx is done first.
+// If ctx is done, conn is closed.
+func handshake(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Unblock the handshake if the context is cancelled
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	err := fn()
+	close(done)
+	conn.SetDeadline(time.Time{})
 
-	tlsConnection := tls.Client(rawConnection, config)
-	if err = tlsConnection.Handshake(); err != nil {
-		return err
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		conn.Close()
+		return ctxErr
 	}
-	c.netConnection = tlsConnection
-	return nil
+	return err
 }
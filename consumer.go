@@ -17,29 +17,86 @@
 package stomp
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gmallard/stompngo"
-	"io"
-	"net"
-	"syscall"
+	"github.com/satori/go.uuid"
+	"sync"
+	"sync/atomic"
 )
 
 type (
-	// Consumer wraps several connections to all broker behind an alias
+	// Consumer wraps several connections to all broker behind an alias.
+	// It is safe for concurrent use.
 	Consumer struct {
+		// Brokers are the brokers connected when the consumer was created. It is not
+		// updated when brokers appear or disappear behind the alias, or start late,
+		// and some of them may be closed since. See CurrentBrokers.
 		Brokers []*Broker
+		// Replaced, never modified, whenever the brokers change
+		brokers []*Broker
+		params  ConnectionParameters
+		events  chan Event
+		stop    chan struct{}
+
+		// mu protects brokers, subscriptions, unreachable and closed
+		mu            sync.Mutex
+		subscriptions map[string]*Subscription
+		unreachable   map[string]*unreachable
+		closed        bool
+	}
+
+	// unreachable is a broker behind the alias that could not be connected to
+	unreachable struct {
+		target target
+		err    error
+		// Stops the background retries. nil once they are over.
+		cancel context.CancelFunc
 	}
 
 	// AckMode is the possible values for the ack
 	AckMode string
 
+	// SubscribeParams holds additional parameters that apply to the subscription.
+	// They are sent again every time the subscription is replayed after a reconnection.
+	SubscribeParams struct {
+		// Subscription id. A random one is used if empty.
+		ID string
+		// Acknowledgement mode. AckAuto if empty.
+		Ack AckMode
+		// JMS selector, for the brokers that support it (i.e. ActiveMQ)
+		Selector string
+		// Maximum number of messages not acknowledged yet that the broker sends.
+		// Sent as activemq.prefetchSize and prefetch-count, so it works with ActiveMQ and
+		// RabbitMQ. Left to the broker if 0.
+		Prefetch int
+		// Name of a durable subscription, kept by the broker while the consumer is away.
+		// The headers used depend on ConnectionParameters.Dialect, and the consumer needs
+		// ConnectionParameters.Durable.
+		Durable string
+		// Any other header, sent as is (i.e. x-queue-name, durable, auto-delete)
+		Headers map[string]string
+	}
+
 	// Message contains messages sent from the broker
 	Message struct {
 		stompngo.Message
 		// Store who sent the message so we can ack/nack
 		broker *Broker
+		// Updated once acknowledged, nil if there is no need
+		inflight *inflight
+		sub      *Subscription
+		// Generation of the connection that delivered the message. The ack id is only
+		// valid on that one.
+		gen uint64
 	}
 )
 
+// subscriptionErrorsSize is the capacity of the error channel of a subscription.
+// Errors are dropped if it is full.
+const subscriptionErrorsSize = 16
+
 const (
 	// AckAuto means messages are automatically considered acknowledged
 	AckAuto = AckMode("auto")
@@ -50,189 +107,490 @@ const (
 )
 
 // NewConsumer creates a new consumer, which will subscribe to all hosts
-// behind params.Address and expose a simplified interface
+// behind params.Address and expose a simplified interface.
+// If params.Address is an SRV record, all its targets are used.
+// If params.Address is a failover URI, a single connection is used instead, which moves
+// between the endpoints. The same goes for WebSocket URLs.
 func NewConsumer(params ConnectionParameters) (*Consumer, error) {
-	host, port, err := net.SplitHostPort(params.Address)
-	if err != nil {
+	return NewConsumerContext(context.Background(), params)
+}
+
+// NewConsumerContext creates a new consumer, giving up if ctx is done before
+// all the connections are established.
+// If params.MinBrokers is set, the consumer is created as long as that many brokers are
+// reachable. Unreachable returns the others, which keep being retried in the background.
+func NewConsumerContext(ctx context.Context, params ConnectionParameters) (*Consumer, error) {
+	if err := params.loadCredentials(); err != nil {
 		return nil, err
 	}
+	if params.Durable && params.ClientID == "" {
+		return nil, ErrDurableClientID
+	}
+
+	c := &Consumer{
+		events:        make(chan Event, eventBufferSize),
+		stop:          make(chan struct{}),
+		subscriptions: make(map[string]*Subscription),
+		unreachable:   make(map[string]*unreachable),
+	}
+	params.events = c.events
+	c.params = params
 
-	if params.EnableTLS {
-		params.caCertPool = loadRootCAs(params.CaPath, params.CaCert)
-		params.clientCerts, err = loadClientCert(params.UserCert, params.UserKey)
+	if isFailover(params.Address) || isWebSocket(params.Address) {
+		broker, err := dial(ctx, params)
 		if err != nil {
 			return nil, err
 		}
+		c.brokers = []*Broker{broker}
+		c.Brokers = c.brokers
+		return c, nil
 	}
 
-	// Get ips behind the alias
-	ips, err := net.LookupIP(host)
+	targets, err := resolveTargets(ctx, &params)
 	if err != nil {
 		return nil, err
 	}
-	c := &Consumer{
-		Brokers: make([]*Broker, len(ips)),
+	brokers, errs := dialTargets(ctx, params, targets)
+
+	required := params.requiredBrokers(len(targets))
+	for i, broker := range brokers {
+		if broker != nil {
+			c.brokers = append(c.brokers, broker)
+		} else if err == nil {
+			err = errs[i]
+		}
+	}
+
+	if len(c.brokers) < required || ctx.Err() != nil {
+		// Make sure we release existing connections on failure
+		for _, broker := range c.brokers {
+			broker.close()
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, err
 	}
-	for i, ip := range ips {
-		newParams := params
-		newParams.Address = net.JoinHostPort(ip.String(), port)
-		if c.Brokers[i], err = dial(newParams); err != nil {
-			goto newConsumerFailed
+	c.Brokers = c.brokers
+
+	c.mu.Lock()
+	for i := range targets {
+		if errs[i] != nil {
+			c.retryLater(targets[i], errs[i])
 		}
 	}
+	c.mu.Unlock()
 
+	if params.ResolveInterval > 0 {
+		go c.watchDNS()
+	}
 	return c, nil
+}
 
-	// Make sure we release existing connections on failure
-newConsumerFailed:
-	for _, broker := range c.Brokers {
-		if broker != nil {
-			broker.close()
-		}
+// Events returns a channel where the state changes of all the brokers are published.
+// Publishing never blocks, so events are dropped if the channel is not drained.
+func (c *Consumer) Events() <-chan Event {
+	return c.events
+}
+
+// CurrentBrokers returns the brokers the consumer is connected to right now. The slice
+// is not modified afterwards, and can be kept.
+func (c *Consumer) CurrentBrokers() []*Broker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.brokers
+}
+
+// Unreachable returns the brokers behind the alias that could not be connected to,
+// indexed by address, with the last error seen for each of them
+func (c *Consumer) Unreachable() map[string]error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]error, len(c.unreachable))
+	for _, u := range c.unreachable {
+		result[u.target.endpoints[0].address] = u.err
 	}
-	return nil, err
+	return result
 }
 
-// Close disconnects and frees resources
+// Close disconnects and frees resources, without waiting for the messages in flight.
+// See Shutdown.
 func (c *Consumer) Close() error {
-	for _, broker := range c.Brokers {
+	brokers, subscriptions, ok := c.markClosed()
+	if !ok {
+		return nil
+	}
+	for _, broker := range brokers {
 		broker.close()
 	}
+	for _, sub := range subscriptions {
+		sub.cancel()
+		<-sub.done
+	}
 	return nil
 }
 
-// subscribeToBroker is called once per broker connection
-func subscribeToBroker(broker *Broker, headers *stompngo.Headers, out chan<- Message) error {
-	in, err := broker.stompConnection.Subscribe(*headers)
+// markClosed stops accepting subscriptions and brokers, and stops the background work.
+// Returns the brokers and subscriptions left, and false if already closed.
+func (c *Consumer) markClosed() ([]*Broker, []*Subscription, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, false
+	}
+	c.closed = true
+	close(c.stop)
+	for _, u := range c.unreachable {
+		if u.cancel != nil {
+			u.cancel()
+		}
+	}
+	subscriptions := make([]*Subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	return c.brokers, subscriptions, true
+}
+
+// attach starts delivering messages from broker into sub. Must be called with mu held.
+func (c *Consumer) attach(sub *Subscription, broker *Broker) {
+	var tracker *inflight
+	if ack := AckMode(sub.headers.Value("ack")); ack != AckAuto && ack != "" {
+		tracker = &inflight{cumulative: ack == AckBulk}
+		sub.inflight[broker] = tracker
+	}
+	sub.active++
+	go func() {
+		if err := subscribeToBroker(broker, sub, tracker); err != nil {
+			sub.reportError(err)
+		}
+		c.detach(sub)
+	}()
+}
+
+// detach is called when a broker stops delivering into sub. When no broker is left,
+// the channels are closed.
+func (c *Consumer) detach(sub *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub.active--
+	if sub.active == 0 {
+		if c.subscriptions[sub.id] == sub {
+			delete(c.subscriptions, sub.id)
+		}
+		close(sub.out)
+		close(sub.errs)
+		close(sub.done)
+		sub.cancel()
+	}
+}
+
+// subscribeToBroker is called once per broker. The broker keeps the subscription across
+// reconnections, so this only forwards the messages. ERROR frames sent by the broker
+// meanwhile are sent to the subscription errors. The messages forwarded are counted by
+// tracker until acknowledged, if set.
+func subscribeToBroker(broker *Broker, sub *Subscription, tracker *inflight) error {
+	ctx := sub.ctx
+	broker.listen(sub.id, sub.reportError)
+	defer broker.unlisten(sub.id)
+
+	registered, err := broker.subscribe(ctx, sub.headers, sub.durable)
 	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrNotConnected) {
+			return nil
+		}
 		return err
 	}
 
-	// Now, this is the trickier part
-	// To handle disconnects, we need to shovel from one channel to the other, and
-	// handle re-subscriptions if the connection is gone
 	for {
-		if frame, ok := <-in; !ok {
-			// Remote channel closed
+		var frame delivery
+		select {
+		case frame = <-registered.frames:
+		case <-registered.done:
+			// Unsubscribed, broker closed, or rejected by the broker
+			return registered.err
+		case <-ctx.Done():
+			// Subscription cancelled
+			broker.drop(sub.id)
+			return nil
+		case <-sub.stopped:
+			// Shutting down. The subscription is dropped once drained.
+			return nil
+		case <-broker.draining:
+			// Gone from the alias. Same as above, but for this broker only.
 			return nil
-		} else if frame.Error == nil {
-			// No error, forward
-			out <- Message{
-				Message: frame.Message,
-				broker:  broker,
+		}
+
+		if frame.Error != nil {
+			broker.drop(sub.id)
+			if errors.Is(frame.Error, ErrNotConnected) {
+				// Consumer closed while reconnecting
+				return nil
 			}
-		} else if frame.Error != io.EOF || broker.params.ConnectionLost == nil {
-			// An error we don't know how to deal with, forward and be done
 			return frame.Error
-		} else {
-			err = frame.Error
-			// Retry loop
-			for err != nil {
-				// Disconnected, notify the client
-				broker.params.ConnectionLost(broker)
-				// If the client had reconnected, we need to resubscribe
-				in, err = broker.stompConnection.Subscribe(*headers)
-			}
-			// If we are here, managed to reconnect and resubscribe!
+		}
+
+		// Forward
+		tracker.add()
+		select {
+		case sub.out <- Message{
+			Message:  frame.Message,
+			broker:   broker,
+			inflight: tracker,
+			sub:      sub,
+			gen:      frame.gen,
+		}:
+			atomic.AddUint64(&sub.delivered, 1)
+		case <-ctx.Done():
+			// Never delivered
+			tracker.done(false)
+		case <-sub.stopped:
+			tracker.done(false)
+			return nil
+		case <-broker.draining:
+			tracker.done(false)
+			return nil
 		}
 	}
 }
 
 // Subscribe to a remote topic or queue
-func (c *Consumer) Subscribe(destination, id string, ack AckMode) (<-chan Message, <-chan error, error) {
-	if id == "" {
-		return nil, nil, stompngo.EBADSID
-	}
+func (c *Consumer) Subscribe(destination string, params SubscribeParams) (*Subscription, error) {
+	return c.SubscribeContext(context.Background(), destination, params)
+}
+
+// SubscribeContext subscribes to a remote topic or queue. When ctx is done, the consumer
+// unsubscribes and the subscription channels are closed.
+func (c *Consumer) SubscribeContext(ctx context.Context, destination string, params SubscribeParams) (*Subscription, error) {
 	if destination == "" {
-		return nil, nil, stompngo.EREQDSTSUB
+		return nil, stompngo.EREQDSTSUB
+	}
+	if params.Durable != "" && !c.params.Durable {
+		return nil, ErrDurableClientID
 	}
 
-	headers := &stompngo.Headers{
+	id := params.ID
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+	if params.Ack == "" {
+		params.Ack = AckAuto
+	}
+	headers := stompngo.Headers{
 		"destination", destination,
 		"id", id,
-		"ack", string(ack),
+		"ack", string(params.Ack),
+	}
+	if params.Selector != "" {
+		headers = headers.Add("selector", params.Selector)
+	}
+	if params.Prefetch > 0 {
+		prefetch := fmt.Sprint(params.Prefetch)
+		headers = headers.Add("activemq.prefetchSize", prefetch).Add("prefetch-count", prefetch)
+	}
+	if params.Headers != nil {
+		for k, v := range params.Headers {
+			headers = headers.Add(k, v)
+		}
 	}
 
-	// Aggregate output channels
-	out := make(chan Message, 100)
-	errs := make(chan error, len(c.Brokers))
-	done := make(chan bool)
+	sub := &Subscription{
+		consumer: c,
+		id:       id,
+		headers:  headers,
+		durable:  params.Durable,
+		// Aggregate output channels
+		out:      make(chan Message, 100),
+		errs:     make(chan error, subscriptionErrorsSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		inflight: make(map[*Broker]*inflight),
+	}
+	// Cancelled on Unsubscribe and Shutdown too
+	sub.ctx, sub.cancel = context.WithCancel(ctx)
 
-	// Supervisor goroutine, closes channels when all brokers are gone
-	go func() {
-		nBrokers := len(c.Brokers)
-		for nDone := 0; nDone < nBrokers; {
-			_ = <-done
-			nDone++
-		}
-		close(out)
-		close(errs)
-		close(done)
-	}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		sub.cancel()
+		return nil, ErrNotConnected
+	}
+	if _, exists := c.subscriptions[id]; exists {
+		sub.cancel()
+		return nil, stompngo.EDUPSID
+	}
+	if len(c.brokers) == 0 {
+		close(sub.out)
+		close(sub.errs)
+		close(sub.done)
+		sub.cancel()
+		return sub, nil
+	}
 
 	// For each connection, spawn a goroutine that will shovel from one connection to the
-	// common channel
-	for _, broker := range c.Brokers {
-		go func(broker *Broker) {
-			if err := subscribeToBroker(broker, headers, out); err != nil {
-				// Ignore errors of duplicated subscriptions
-				// Possibly one of the hosts has more than one IP (i.e. 4 and 6)
-				if err != stompngo.EDUPSID {
-					errs <- err
-				}
-			}
-			done <- true
-		}(broker)
+	// common channel. Brokers that appear later are attached too.
+	c.subscriptions[id] = sub
+	for _, broker := range c.brokers {
+		c.attach(sub, broker)
 	}
 
-	return out, errs, nil
+	return sub, nil
 }
 
 // Unsubscribe from an existing subscription
-func (c *Consumer) Unsubscribe(id string) (err error) {
+func (c *Consumer) Unsubscribe(id string) error {
+	return c.UnsubscribeContext(context.Background(), id)
+}
+
+// UnsubscribeContext unsubscribes from an existing subscription, giving up if ctx is done
+// before all brokers are notified
+func (c *Consumer) UnsubscribeContext(ctx context.Context, id string) error {
 	if id == "" {
 		return stompngo.EBADSID
 	}
 
-	headers := stompngo.Headers{
-		"id", id,
+	c.mu.Lock()
+	sub := c.subscriptions[id]
+	c.mu.Unlock()
+	if sub == nil {
+		return nil
 	}
-	for _, broker := range c.Brokers {
-		for {
-			if err = broker.handleReconnectOnSend(
-				broker.stompConnection.Unsubscribe(headers),
-			); err != syscall.EAGAIN {
-				break
-			}
+	return c.unsubscribe(ctx, sub, false)
+}
+
+// UnsubscribeDurable ends an existing subscription, and removes its durable subscription
+// from the brokers, so the messages stop being kept for it. Returns ErrNotSubscribed if
+// the subscription is not active, since the brokers can only remove active ones.
+func (c *Consumer) UnsubscribeDurable(id string) error {
+	return c.UnsubscribeDurableContext(context.Background(), id)
+}
+
+// UnsubscribeDurableContext is UnsubscribeDurable, giving up if ctx is done before all
+// brokers are notified
+func (c *Consumer) UnsubscribeDurableContext(ctx context.Context, id string) error {
+	if id == "" {
+		return stompngo.EBADSID
+	}
+
+	c.mu.Lock()
+	sub := c.subscriptions[id]
+	c.mu.Unlock()
+	if sub == nil {
+		return ErrNotSubscribed
+	}
+	return c.unsubscribe(ctx, sub, true)
+}
+
+// unsubscribe ends sub on all brokers, and waits for its goroutines to be done.
+// If durable is set, the durable subscription is removed too.
+func (c *Consumer) unsubscribe(ctx context.Context, sub *Subscription, durable bool) (err error) {
+	// Do not attach to new brokers
+	c.mu.Lock()
+	active := c.subscriptions[sub.id] == sub
+	if active {
+		delete(c.subscriptions, sub.id)
+	}
+	brokers := c.brokers
+	c.mu.Unlock()
+	if durable && !active {
+		return ErrNotSubscribed
+	}
+
+	for _, broker := range brokers {
+		if unsubscribeErr := broker.unsubscribe(ctx, sub.id, durable); err == nil {
+			err = unsubscribeErr
+		}
+	}
+
+	// Unblock the deliveries in progress
+	sub.cancel()
+	select {
+	case <-sub.done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
 		}
 	}
 	return
 }
 
-// Ack acknowledges the message
-func (m *Message) Ack() (err error) {
-	headers := stompngo.Headers{
-		"message-id", m.Message.Headers.Value("message-id"),
-		"subscription", m.Message.Headers.Value("subscription"),
+// ackHeaders returns the headers that identify the message for an ACK or NACK frame,
+// which depend on the negotiated protocol version
+func (m *Message) ackHeaders(conn *stompngo.Connection) stompngo.Headers {
+	switch conn.Protocol() {
+	case stompngo.SPL_12:
+		return stompngo.Headers{
+			"id", m.Message.Headers.Value("ack"),
+		}
+	case stompngo.SPL_11:
+		return stompngo.Headers{
+			"message-id", m.Message.Headers.Value("message-id"),
+			"subscription", m.Message.Headers.Value("subscription"),
+		}
+	default:
+		return stompngo.Headers{
+			"message-id", m.Message.Headers.Value("message-id"),
+		}
 	}
-	for {
-		if err = m.broker.handleReconnectOnSend(m.broker.stompConnection.Ack(headers)); err != syscall.EAGAIN {
-			break
+}
+
+// Ack acknowledges the message
+func (m *Message) Ack() error {
+	return m.AckContext(context.Background())
+}
+
+// AckContext acknowledges the message, giving up if ctx is done before the
+// acknowledgement could be sent
+func (m *Message) AckContext(ctx context.Context) error {
+	err := m.acknowledge(ctx, func(conn *stompngo.Connection) func(stompngo.Headers) error {
+		return conn.Ack
+	})
+	if err == nil {
+		m.inflight.done(true)
+		if m.sub != nil {
+			atomic.AddUint64(&m.sub.acked, 1)
 		}
 	}
-	return
+	return err
 }
 
-// Nack tells the broker that the message has not been consumed
-func (m *Message) Nack() (err error) {
-	headers := stompngo.Headers{
-		"message-id", m.Message.Headers.Value("message-id"),
-		"subscription", m.Message.Headers.Value("subscription"),
+// Nack tells the broker that the message has not been consumed.
+// Not supported by STOMP 1.0.
+func (m *Message) Nack() error {
+	return m.NackContext(context.Background())
+}
+
+// NackContext tells the broker that the message has not been consumed, giving up
+// if ctx is done before the notification could be sent
+func (m *Message) NackContext(ctx context.Context) error {
+	err := m.acknowledge(ctx, func(conn *stompngo.Connection) func(stompngo.Headers) error {
+		return conn.Nack
+	})
+	if err == nil {
+		m.inflight.done(true)
+		if m.sub != nil {
+			atomic.AddUint64(&m.sub.nacked, 1)
+		}
 	}
-	for {
-		if err = m.broker.handleReconnectOnSend(m.broker.stompConnection.Nack(headers)); err != syscall.EAGAIN {
-			break
+	return err
+}
+
+// acknowledge sends the frame returned by op for the message, on the connection that
+// delivered it. If that one is gone, the message is redelivered by the broker, so
+// nothing is sent and an ErrConnectionLost is returned.
+func (m *Message) acknowledge(ctx context.Context, op func(*stompngo.Connection) func(stompngo.Headers) error) error {
+	err := m.broker.retry(ctx, func(conn *stompngo.Connection) error {
+		if _, gen := m.broker.current(); gen != m.gen {
+			return wrapError(ErrConnectionLost, errStaleMessage)
+		}
+		if m.broker.params.Receipts {
+			return m.broker.withReceipt(ctx, conn, m.ackHeaders(conn), op(conn))
 		}
+		return op(conn)(m.ackHeaders(conn))
+	})
+	if errors.Is(err, errStaleMessage) {
+		// Not pending anymore, it is up to the broker now
+		m.inflight.done(false)
 	}
-	return
+	return err
 }
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+)
+
+// IPPreference selects the address family tried first for dual-stack brokers
+type IPPreference int
+
+const (
+	// PreferIPv6 tries the IPv6 addresses first
+	PreferIPv6 = IPPreference(iota)
+	// PreferIPv4 tries the IPv4 addresses first
+	PreferIPv4
+)
+
+// DefaultFallbackDelay is how long the preferred address family has before the
+// next address is raced, as recommended by RFC 8305
+const DefaultFallbackDelay = 300 * time.Millisecond
+
+// fallbackDelay returns the delay to use when racing the endpoints, or 0 if disabled
+func (p *ConnectionParameters) fallbackDelay() time.Duration {
+	if p.FallbackDelay < 0 {
+		return 0
+	} else if p.FallbackDelay == 0 {
+		return DefaultFallbackDelay
+	}
+	return p.FallbackDelay
+}
+
+// preferred returns true if ip belongs to the preferred address family
+func (pref IPPreference) preferred(ip net.IP) bool {
+	isIPv4 := ip.To4() != nil
+	if pref == PreferIPv4 {
+		return isIPv4
+	}
+	return !isIPv4
+}
+
+// sortByPreference puts the addresses of the preferred family first, keeping the resolver
+// order otherwise
+func sortByPreference(endpoints []endpoint, ips []net.IP, pref IPPreference) {
+	sort.Stable(&byPreference{endpoints, ips, pref})
+}
+
+// byPreference sorts endpoints, and their matching IPs, by address family
+type byPreference struct {
+	endpoints []endpoint
+	ips       []net.IP
+	pref      IPPreference
+}
+
+func (b *byPreference) Len() int {
+	return len(b.endpoints)
+}
+
+func (b *byPreference) Less(i, j int) bool {
+	return b.pref.preferred(b.ips[i]) && !b.pref.preferred(b.ips[j])
+}
+
+func (b *byPreference) Swap(i, j int) {
+	b.endpoints[i], b.endpoints[j] = b.endpoints[j], b.endpoints[i]
+	b.ips[i], b.ips[j] = b.ips[j], b.ips[i]
+}
+
+// dialHappyEyeballs races the network connections to the endpoints, in order, giving each
+// one a head start of delay over the next one. A failure starts the next one right away.
+// The first successful connection is returned with its endpoint, and the others are closed.
+func (c *Broker) dialHappyEyeballs(ctx context.Context, endpoints []endpoint, delay time.Duration) (endpoint, net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ep   endpoint
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(endpoints))
+
+	next, pending := 0, 0
+	var fallback <-chan time.Time
+	start := func() {
+		ep := endpoints[next]
+		next++
+		pending++
+		go func() {
+			conn, err := c.dialEndpoint(ctx, ep)
+			results <- result{ep, conn, err}
+		}()
+		if next < len(endpoints) {
+			fallback = time.After(delay)
+		} else {
+			fallback = nil
+		}
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case <-fallback:
+			start()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Release whatever else manages to connect
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if lost := <-results; lost.conn != nil {
+							lost.conn.Close()
+						}
+					}
+				}(pending)
+				return r.ep, r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(endpoints) && ctx.Err() == nil {
+				start()
+			}
+		}
+	}
+	return endpoint{}, nil, firstErr
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"fmt"
+	"github.com/gmallard/stompngo"
+	"strings"
+)
+
+// Dialect is the flavour of broker, which decides the headers used for durable subscriptions
+type Dialect string
+
+const (
+	// DialectAuto detects the dialect from the server header sent by the broker.
+	// If it is not recognised, the headers of all the dialects are sent.
+	DialectAuto = Dialect("")
+	// DialectActiveMQ is ActiveMQ "Classic"
+	DialectActiveMQ = Dialect("activemq")
+	// DialectArtemis is ActiveMQ Artemis
+	DialectArtemis = Dialect("artemis")
+	// DialectRabbitMQ is RabbitMQ with the STOMP plugin
+	DialectRabbitMQ = Dialect("rabbitmq")
+)
+
+// ParseDialect parses the string representation of a Dialect
+func ParseDialect(s string) (Dialect, error) {
+	switch d := Dialect(strings.ToLower(s)); d {
+	case DialectAuto, DialectActiveMQ, DialectArtemis, DialectRabbitMQ:
+		return d, nil
+	case "auto":
+		return DialectAuto, nil
+	}
+	return DialectAuto, fmt.Errorf("stomp: unknown dialect %q", s)
+}
+
+// detectDialect guesses the dialect from the server header of the CONNECTED frame
+func detectDialect(server string) Dialect {
+	server = strings.ToLower(server)
+	switch {
+	case strings.Contains(server, "artemis"):
+		return DialectArtemis
+	case strings.Contains(server, "activemq"):
+		return DialectActiveMQ
+	case strings.Contains(server, "rabbitmq"):
+		return DialectRabbitMQ
+	}
+	return DialectAuto
+}
+
+// dialect returns the dialect of the broker connected through conn
+func (c *Broker) dialect(conn *stompngo.Connection) Dialect {
+	if c.params.Dialect != DialectAuto || conn == nil || conn.ConnectResponse == nil {
+		return c.params.Dialect
+	}
+	return detectDialect(conn.ConnectResponse.Headers.Value("server"))
+}
+
+// durableHeaders returns the headers that make the subscription name durable
+func durableHeaders(dialect Dialect, name string) stompngo.Headers {
+	switch dialect {
+	case DialectActiveMQ:
+		return stompngo.Headers{"activemq.subscriptionName", name}
+	case DialectArtemis:
+		return stompngo.Headers{"durable-subscription-name", name}
+	case DialectRabbitMQ:
+		return stompngo.Headers{"durable", "true", "auto-delete", "false", "x-queue-name", name}
+	}
+	return stompngo.Headers{
+		"activemq.subscriptionName", name,
+		"durable-subscription-name", name,
+		"durable", "true",
+		"auto-delete", "false",
+		"x-queue-name", name,
+	}
+}
+
+// removeDurableHeaders returns the headers that make an UNSUBSCRIBE remove the durable
+// subscription name from the broker, instead of just deactivating it
+func removeDurableHeaders(dialect Dialect, name string) stompngo.Headers {
+	switch dialect {
+	case DialectActiveMQ:
+		return stompngo.Headers{"activemq.subscriptionName", name}
+	case DialectArtemis:
+		return stompngo.Headers{"durable-subscription-name", name}
+	case DialectRabbitMQ:
+		return stompngo.Headers{"durable", "true"}
+	}
+	return stompngo.Headers{
+		"activemq.subscriptionName", name,
+		"durable-subscription-name", name,
+		"durable", "true",
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"errors"
+	"github.com/gmallard/stompngo"
+	"strings"
+)
+
+var (
+	// ErrConnectionLost is returned when the connection to the broker is gone and could
+	// not be recovered. The underlying cause can be retrieved with errors.Unwrap.
+	ErrConnectionLost = errors.New("stomp: connection lost")
+	// ErrAuthentication is returned when the broker rejects the credentials.
+	// It comes wrapped in a *BrokerError with the details.
+	ErrAuthentication = errors.New("stomp: authentication failed")
+	// ErrNotConnected is returned when using a broker, consumer or producer after Close
+	ErrNotConnected = errors.New("stomp: not connected")
+	// ErrDurableClientID is returned when durable subscriptions are used without a stable
+	// client id (see ConnectionParameters.Durable)
+	ErrDurableClientID = errors.New("stomp: durable subscriptions need a stable client id")
+	// ErrNotSubscribed is returned when removing a durable subscription that is not active.
+	// Subscribe again with the same durable name, then remove it.
+	ErrNotSubscribed = errors.New("stomp: not subscribed")
+)
+
+// errRetry is returned internally when an operation failed because of a lost connection,
+// which has been recovered, so the operation can be tried again
+var errRetry = errors.New("stomp: retry")
+
+// errStaleMessage is wrapped in ErrConnectionLost when acknowledging a message delivered
+// on a connection that is gone. The broker redelivers it.
+var errStaleMessage = errors.New("stomp: message delivered on a previous connection")
+
+// authenticationHints are the substrings that identify, on the message of an ERROR
+// frame sent in response to CONNECT, a rejection of the credentials
+var authenticationHints = []string{
+	"auth", "password", "credential", "login", "access refused", "access denied",
+	"not allowed", "security", "permission",
+}
+
+type (
+	// BrokerError is an ERROR frame sent by the broker
+	BrokerError struct {
+		Headers stompngo.Headers
+		Body    string
+		// Kind of error, if known (i.e. ErrAuthentication)
+		Err error
+	}
+
+	// wrappedError matches kind with errors.Is, and unwraps to cause
+	wrappedError struct {
+		kind  error
+		cause error
+	}
+)
+
+// newBrokerError builds a BrokerError from an ERROR frame
+func newBrokerError(frame *stompngo.Message) *BrokerError {
+	return &BrokerError{
+		Headers: frame.Headers,
+		Body:    frame.BodyString(),
+	}
+}
+
+// newConnectError builds a BrokerError from the ERROR frame sent in response to CONNECT
+func newConnectError(frame *stompngo.Message) *BrokerError {
+	err := newBrokerError(frame)
+	message := strings.ToLower(err.Message())
+	for _, hint := range authenticationHints {
+		if strings.Contains(message, hint) {
+			err.Err = ErrAuthentication
+			break
+		}
+	}
+	return err
+}
+
+// Message returns the message header of the ERROR frame or, if empty, the body
+func (e *BrokerError) Message() string {
+	if message := e.Headers.Value("message"); message != "" {
+		return message
+	}
+	return strings.TrimSpace(e.Body)
+}
+
+// Error implements error
+func (e *BrokerError) Error() string {
+	return "stomp: broker error: " + e.Message()
+}
+
+// Unwrap returns the kind of error, if known
+func (e *BrokerError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError returns an error that matches kind, and unwraps to cause
+func wrapError(kind, cause error) error {
+	if cause == nil {
+		return kind
+	}
+	return &wrappedError{kind: kind, cause: cause}
+}
+
+// Error implements error
+func (e *wrappedError) Error() string {
+	return e.kind.Error() + ": " + strings.TrimPrefix(e.cause.Error(), "stomp: ")
+}
+
+// Is makes errors.Is match the kind of error
+func (e *wrappedError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Unwrap returns the underlying cause
+func (e *wrappedError) Unwrap() error {
+	return e.cause
+}
+
+// lostConnectionError wraps err as ErrConnectionLost if it means the connection is gone
+func lostConnectionError(err error) error {
+	if err != nil && isConnectionLost(err) {
+		return wrapError(ErrConnectionLost, err)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"time"
+)
+
+type (
+	// EventType identifies a change on the state of a broker connection
+	EventType int
+
+	// Event notifies a change on the state of a broker connection
+	Event struct {
+		Type EventType
+		// Address of the broker
+		Address string
+		// Error that triggered the event, if any
+		Err  error
+		Time time.Time
+	}
+)
+
+const (
+	// EventConnecting is sent when a connection is being established
+	EventConnecting = EventType(iota)
+	// EventConnected is sent when the connection has been established
+	EventConnected
+	// EventDisconnected is sent when the connection is lost or closed
+	EventDisconnected
+	// EventReconnecting is sent before each reconnection attempt
+	EventReconnecting
+	// EventResubscribed is sent when a subscription is restored after a reconnection
+	EventResubscribed
+	// EventGaveUp is sent when the reconnect policy has been exhausted
+	EventGaveUp
+	// EventUnreachable is sent when a broker behind a consumer alias can not be reached,
+	// and will be retried in the background
+	EventUnreachable
+)
+
+// eventBufferSize is how many events are kept if nobody is reading them.
+// Newer events are dropped when the buffer is full.
+const eventBufferSize = 64
+
+// String implements fmt.Stringer
+func (t EventType) String() string {
+	switch t {
+	case EventConnecting:
+		return "Connecting"
+	case EventConnected:
+		return "Connected"
+	case EventDisconnected:
+		return "Disconnected"
+	case EventReconnecting:
+		return "Reconnecting"
+	case EventResubscribed:
+		return "Resubscribed"
+	case EventGaveUp:
+		return "GaveUp"
+	case EventUnreachable:
+		return "Unreachable"
+	}
+	return "Unknown"
+}
+
+// Events returns a channel where the state changes of this broker are published.
+// Publishing never blocks, so events are dropped if the channel is not drained.
+func (c *Broker) Events() <-chan Event {
+	return c.events
+}
+
+// emit publishes an event without blocking
+func (c *Broker) emit(t EventType, err error) {
+	event := Event{
+		Type:    t,
+		Address: c.address(),
+		Err:     err,
+		Time:    time.Now(),
+	}
+	select {
+	case c.events <- event:
+	default:
+	}
+	if c.params.events != nil {
+		select {
+		case c.params.events <- event:
+		default:
+		}
+	}
+}
+
+// notify publishes an event about a broker that has no connection, without blocking
+func notify(events chan Event, t EventType, address string, err error) {
+	select {
+	case events <- Event{Type: t, Address: address, Err: err, Time: time.Now()}:
+	default:
+	}
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// endpoint is a single broker address
+	endpoint struct {
+		// Host:Port
+		address string
+		// Host name, used for the TLS verification
+		host string
+		// Default value for the STOMP host header
+		vhost string
+		tls   bool
+		// Set for STOMP over WebSocket, with the URL to connect to
+		websocket bool
+		url       string
+	}
+
+	// failover is the list of endpoints a Broker can connect to
+	failover struct {
+		endpoints []endpoint
+		randomize bool
+		// If set, the endpoints are looked up from this SRV record before each connection
+		srv string
+		tls bool
+		// If positive, the endpoints are raced, starting the next one after this delay
+		fallbackDelay time.Duration
+	}
+)
+
+const failoverPrefix = "failover:"
+
+// isFailover returns true if the address is a failover URI
+func isFailover(address string) bool {
+	return strings.HasPrefix(address, failoverPrefix)
+}
+
+// order returns the endpoints in the order they should be tried.
+// Not safe for concurrent use.
+func (f *failover) order(ctx context.Context) ([]endpoint, error) {
+	if f.srv != "" {
+		// SRV records come sorted by priority and weight. Keep the last known ones on failure.
+		endpoints, err := lookupSRV(ctx, f.srv, f.tls)
+		if err == nil {
+			f.endpoints = endpoints
+		} else if len(f.endpoints) == 0 {
+			return nil, err
+		}
+	}
+	if len(f.endpoints) == 0 {
+		return nil, errors.New("stomp: no endpoints to connect to")
+	}
+	if !f.randomize {
+		return f.endpoints, nil
+	}
+	shuffled := make([]endpoint, len(f.endpoints))
+	for i, j := range rand.Perm(len(f.endpoints)) {
+		shuffled[i] = f.endpoints[j]
+	}
+	return shuffled, nil
+}
+
+// parseAddress parses params.Address, which can be either host:port, a WebSocket URL,
+// a DNS SRV record name (_stomp._tcp.example.com),
+// or a failover URI as failover:(stomp://a:61613,stomp+ssl://b:61614)?randomize=false
+// Reconnect options on the failover URI override params.ReconnectPolicy.
+func parseAddress(params *ConnectionParameters) (*failover, error) {
+	if isSRV(params.Address) {
+		return &failover{srv: params.Address, tls: params.EnableTLS}, nil
+	} else if isWebSocket(params.Address) {
+		ep, err := parseEndpoint(params.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &failover{endpoints: []endpoint{ep}}, nil
+	} else if !isFailover(params.Address) {
+		host, _, err := net.SplitHostPort(params.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &failover{
+			endpoints: []endpoint{{address: params.Address, host: host, vhost: host, tls: params.EnableTLS}},
+		}, nil
+	}
+
+	uris, query, err := splitFailover(params.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &failover{randomize: true}
+	for _, uri := range uris {
+		ep, err := parseEndpoint(uri)
+		if err != nil {
+			return nil, err
+		}
+		f.endpoints = append(f.endpoints, ep)
+	}
+	if len(f.endpoints) == 0 {
+		return nil, fmt.Errorf("stomp: no endpoints in failover URI %s", params.Address)
+	}
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if err = applyFailoverOptions(f, params, options); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// splitFailover splits a failover URI into the URIs of its endpoints, and its query
+func splitFailover(address string) (uris []string, query string, err error) {
+	group := strings.TrimPrefix(address, failoverPrefix)
+	if strings.HasPrefix(group, "(") {
+		end := strings.Index(group, ")")
+		if end < 0 {
+			return nil, "", fmt.Errorf("stomp: unbalanced parenthesis in failover URI %s", address)
+		}
+		query = strings.TrimPrefix(group[end+1:], "?")
+		group = group[1:end]
+	} else if i := strings.Index(group, "?"); i >= 0 {
+		query = group[i+1:]
+		group = group[:i]
+	}
+	for _, uri := range strings.Split(group, ",") {
+		uris = append(uris, strings.TrimSpace(uri))
+	}
+	return
+}
+
+// parseEndpoint parses a single URI from a failover list
+func parseEndpoint(uri string) (ep endpoint, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "stomp", "tcp":
+	case "stomp+ssl", "stomp+tls", "ssl", "tls":
+		ep.tls = true
+	case "ws":
+		ep.websocket = true
+		ep.url = uri
+	case "wss":
+		ep.websocket = true
+		ep.tls = true
+		ep.url = uri
+	default:
+		err = fmt.Errorf("stomp: unsupported scheme in %s", uri)
+		return
+	}
+	if u.Hostname() == "" {
+		err = fmt.Errorf("stomp: missing host in %s", uri)
+		return
+	}
+	if u.Port() == "" && !ep.websocket {
+		err = fmt.Errorf("stomp: missing port in %s", uri)
+		return
+	}
+	ep.address = u.Host
+	ep.host = u.Hostname()
+	ep.vhost = ep.host
+	return
+}
+
+// unsupportedFailoverOptions are ActiveMQ failover options that have no equivalent here.
+// They are ignored, so URIs can be copied from existing ActiveMQ configurations.
+var unsupportedFailoverOptions = map[string]bool{
+	"timeout":                     true,
+	"startupMaxReconnectAttempts": true,
+	"priorityBackup":              true,
+	"priorityURIs":                true,
+	"backup":                      true,
+	"backupPoolSize":              true,
+	"trackMessages":               true,
+	"trackTransactionProducers":   true,
+	"maxCacheSize":                true,
+	"maxPullCacheSize":            true,
+	"updateURIsSupported":         true,
+	"updateURIsURL":               true,
+	"rebalanceUpdateURIs":         true,
+	"reconnectDelayExponent":      true,
+	"reconnectSupported":          true,
+	"warnAfterReconnectAttempts":  true,
+}
+
+// ignoredFailoverOption returns true if key is an ActiveMQ failover option to be ignored.
+// Options for the nested URIs (nested.*) are ignored too.
+func ignoredFailoverOption(key string) bool {
+	return unsupportedFailoverOptions[key] || strings.HasPrefix(key, "nested.")
+}
+
+// applyFailoverOptions parses the failover URI query options
+func applyFailoverOptions(f *failover, params *ConnectionParameters, options url.Values) error {
+	var policy ReconnectPolicy
+	if params.ReconnectPolicy != nil {
+		policy = *params.ReconnectPolicy
+	} else {
+		policy = DefaultReconnectPolicy
+	}
+	exponential := true
+	reconnect := false
+	disableReconnect := false
+
+	for key := range options {
+		value := options.Get(key)
+		var err error
+		switch key {
+		case "randomize":
+			f.randomize, err = strconv.ParseBool(value)
+		case "initialReconnectDelay":
+			policy.InitialDelay, err = parseMilliseconds(value)
+			reconnect = true
+		case "maxReconnectDelay":
+			policy.MaxDelay, err = parseMilliseconds(value)
+			reconnect = true
+		case "useExponentialBackOff":
+			exponential, err = strconv.ParseBool(value)
+			reconnect = true
+		case "backOffMultiplier":
+			policy.Multiplier, err = strconv.ParseFloat(value, 64)
+			reconnect = true
+		case "maxReconnectAttempts":
+			// -1 means unlimited, 0 means no reconnection at all
+			policy.MaxAttempts, err = strconv.Atoi(value)
+			if policy.MaxAttempts < 0 {
+				policy.MaxAttempts = 0
+			} else if policy.MaxAttempts == 0 {
+				disableReconnect = true
+			}
+			reconnect = true
+		default:
+			if !ignoredFailoverOption(key) {
+				err = fmt.Errorf("unknown option")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("stomp: invalid failover option %s=%s: %s", key, value, err)
+		}
+	}
+
+	if !exponential {
+		policy.Multiplier = 1
+	}
+	if disableReconnect {
+		params.ReconnectPolicy = nil
+	} else if reconnect {
+		params.ReconnectPolicy = &policy
+	}
+	return nil
+}
+
+// parseMilliseconds parses a duration expressed in milliseconds
+func parseMilliseconds(value string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
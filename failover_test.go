@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address   string
+		endpoints []string
+		randomize bool
+	}{
+		{"broker:61613", []string{"broker:61613"}, false},
+		{"wss://broker/stomp", []string{"broker"}, false},
+		{"failover:(stomp://a:1,stomp+ssl://b:2)", []string{"a:1", "b:2"}, true},
+		{"failover:stomp://a:1,stomp://b:2?randomize=false", []string{"a:1", "b:2"}, false},
+	}
+	for _, test := range tests {
+		params := ConnectionParameters{Address: test.address}
+		f, err := parseAddress(&params)
+		if err != nil {
+			t.Errorf("%s: %s", test.address, err)
+			continue
+		}
+		if len(f.endpoints) != len(test.endpoints) {
+			t.Errorf("%s: expected %d endpoints, got %d", test.address, len(test.endpoints), len(f.endpoints))
+			continue
+		}
+		for i, ep := range f.endpoints {
+			if ep.address != test.endpoints[i] {
+				t.Errorf("%s: expected endpoint %s, got %s", test.address, test.endpoints[i], ep.address)
+			}
+		}
+		if f.randomize != test.randomize {
+			t.Errorf("%s: expected randomize %t", test.address, test.randomize)
+		}
+	}
+}
+
+func TestParseAddressTLS(t *testing.T) {
+	params := ConnectionParameters{Address: "failover:(stomp://a:1,stomp+ssl://b:2)"}
+	f, err := parseAddress(&params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.endpoints[0].tls || !f.endpoints[1].tls {
+		t.Errorf("TLS not taken from the scheme of each endpoint")
+	}
+}
+
+func TestParseAddressReconnectOptions(t *testing.T) {
+	params := ConnectionParameters{
+		Address: "failover:(stomp://a:1)?initialReconnectDelay=100&maxReconnectDelay=5000&backOffMultiplier=3&maxReconnectAttempts=4",
+	}
+	if _, err := parseAddress(&params); err != nil {
+		t.Fatal(err)
+	}
+	policy := params.ReconnectPolicy
+	if policy == nil {
+		t.Fatal("expected a reconnect policy")
+	}
+	if policy.InitialDelay != 100*time.Millisecond || policy.MaxDelay != 5*time.Second ||
+		policy.Multiplier != 3 || policy.MaxAttempts != 4 {
+		t.Errorf("unexpected policy %+v", *policy)
+	}
+
+	params = ConnectionParameters{
+		Address:         "failover:(stomp://a:1)?maxReconnectAttempts=0",
+		ReconnectPolicy: &DefaultReconnectPolicy,
+	}
+	if _, err := parseAddress(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.ReconnectPolicy != nil {
+		t.Error("maxReconnectAttempts=0 must disable reconnection")
+	}
+}
+
+func TestParseAddressErrors(t *testing.T) {
+	tests := []string{
+		"broker",
+		"failover:(stomp://a:1",
+		"failover:()",
+		"failover:(http://a:1)",
+		"failover:(stomp://a)",
+		"failover:(stomp://a:1)?randomize=maybe",
+	}
+	for _, address := range tests {
+		params := ConnectionParameters{Address: address}
+		if _, err := parseAddress(&params); err == nil {
+			t.Errorf("%s: expected an error", address)
+		}
+	}
+}
+
+func TestParseAddressActiveMQOptions(t *testing.T) {
+	for _, address := range []string{
+		"failover:(stomp://a:1)?timeout=3000",
+		"failover:(stomp://a:1,stomp://b:2)?priorityBackup=true&startupMaxReconnectAttempts=3&nested.wireFormat.maxInactivityDuration=0",
+	} {
+		params := ConnectionParameters{Address: address}
+		if _, err := parseAddress(&params); err != nil {
+			t.Errorf("%s: %s", address, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"github.com/gmallard/stompngo"
+	"github.com/satori/go.uuid"
+	"io"
+	"sync"
+)
+
+// dispatcher routes the frames of a connection that do not belong to a subscription
+// (RECEIPT and ERROR) to whoever is waiting for them
+type dispatcher struct {
+	mu sync.Mutex
+	// Waiting for a RECEIPT, by receipt id
+	receipts map[string]chan error
+	// Set once the connection is gone
+	err  error
+	done chan struct{}
+}
+
+// newDispatcher returns a dispatcher for a new connection
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		receipts: make(map[string]chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// expect registers a receipt id. The returned channel gets nil when the RECEIPT arrives,
+// a *BrokerError if an ERROR arrives instead, or the cause if the connection is lost.
+func (d *dispatcher) expect(id string) <-chan error {
+	ch := make(chan error, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		ch <- d.err
+	} else {
+		d.receipts[id] = ch
+	}
+	return ch
+}
+
+// forget stops waiting for a receipt
+func (d *dispatcher) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.receipts, id)
+}
+
+// resolve notifies whoever waits for the receipt id. Returns false if nobody does.
+func (d *dispatcher) resolve(id string, err error) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ch, ok := d.receipts[id]
+	if ok {
+		delete(d.receipts, id)
+		ch <- err
+	}
+	return ok
+}
+
+// fail notifies all pending receipts that the connection is gone, and stops the dispatcher
+func (d *dispatcher) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return
+	}
+	d.err = err
+	for id, ch := range d.receipts {
+		ch <- err
+		delete(d.receipts, id)
+	}
+	close(d.done)
+}
+
+// watchFrames reads the frames that do not belong to a subscription, until the
+// connection is gone, starting its recovery. SUBSCRIBE and UNSUBSCRIBE carry a receipt,
+// so an ERROR in response reaches whoever sent them. Only ERROR frames that can not be
+// attributed are sent to all the subscriptions.
+func (c *Broker) watchFrames(conn *stompngo.Connection, d *dispatcher, gen uint64) {
+	for {
+		var frame stompngo.MessageData
+		var ok bool
+		select {
+		case frame, ok = <-conn.MessageData:
+		case <-d.done:
+			return
+		}
+
+		if !ok {
+			d.fail(io.EOF)
+			return
+		} else if frame.Error != nil {
+			d.fail(frame.Error)
+			if isConnectionLost(frame.Error) {
+				c.recoverInBackground(gen, frame.Error)
+			}
+			return
+		}
+
+		switch frame.Message.Command {
+		case stompngo.RECEIPT:
+			d.resolve(frame.Message.Headers.Value("receipt-id"), nil)
+		case stompngo.ERROR:
+			brokerErr := newBrokerError(&frame.Message)
+			if !d.resolve(brokerErr.Headers.Value("receipt-id"), brokerErr) {
+				c.broadcast(brokerErr)
+			}
+		}
+	}
+}
+
+// stopDispatcher fails the receipts pending on the current connection, if any.
+// Must be called with mu held.
+func (c *Broker) stopDispatcher() {
+	if c.dispatcher != nil {
+		c.dispatcher.fail(stompngo.ECONBAD)
+		c.dispatcher = nil
+	}
+}
+
+// dispatcherFor returns the dispatcher of conn, or ECONBAD if it is not the current
+// connection anymore
+func (c *Broker) dispatcherFor(conn *stompngo.Connection) (*dispatcher, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.stompConnection != conn || c.dispatcher == nil {
+		return nil, stompngo.ECONBAD
+	}
+	return c.dispatcher, nil
+}
+
+// withReceipt runs op with a receipt header added to headers, and waits for the broker
+// to confirm it. An ERROR frame sent in response is returned as a *BrokerError.
+// If headers already have a receipt, that one is used.
+func (c *Broker) withReceipt(ctx context.Context, conn *stompngo.Connection, headers stompngo.Headers, op func(stompngo.Headers) error) error {
+	d, err := c.dispatcherFor(conn)
+	if err != nil {
+		return err
+	}
+
+	id := headers.Value("receipt")
+	if id == "" {
+		id = uuid.NewV4().String()
+		headers = headers.Add("receipt", id)
+	}
+	receipt := d.expect(id)
+	if err = op(headers); err != nil {
+		d.forget(id)
+		return err
+	}
+
+	select {
+	case err = <-receipt:
+		return err
+	case <-ctx.Done():
+		d.forget(id)
+		return ctx.Err()
+	}
+}
+
+// listen registers report to be called with the ERROR frames not correlated with a receipt
+func (c *Broker) listen(id string, report func(error)) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	if c.listeners == nil {
+		c.listeners = make(map[string]func(error))
+	}
+	c.listeners[id] = report
+}
+
+// unlisten unregisters the listener id. Nothing is sent to it afterwards.
+func (c *Broker) unlisten(id string) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	delete(c.listeners, id)
+}
+
+// broadcast reports err to all listeners, which must not block
+func (c *Broker) broadcast(err error) {
+	c.listenersMu.Lock()
+	defer c.listenersMu.Unlock()
+	for _, report := range c.listeners {
+		report(err)
+	}
+}
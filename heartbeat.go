@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// heartBeatGrace is how many receive intervals can be missed before the broker is
+// declared dead, to account for network latency
+const heartBeatGrace = 2
+
+// livenessConn keeps track of the last time something was read from the connection
+type livenessConn struct {
+	net.Conn
+	lastRead int64
+}
+
+func newLivenessConn(conn net.Conn) *livenessConn {
+	return &livenessConn{
+		Conn:     conn,
+		lastRead: time.Now().UnixNano(),
+	}
+}
+
+// Read implements net.Conn
+func (l *livenessConn) Read(b []byte) (int, error) {
+	n, err := l.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&l.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// idle returns how long since the last read
+func (l *livenessConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&l.lastRead)))
+}
+
+// heartBeatHeader returns the value for the CONNECT heart-beat header
+func (p *ConnectionParameters) heartBeatHeader() string {
+	return fmt.Sprintf("%d,%d", p.ClientHeartBeat/time.Millisecond, p.ServerHeartBeat/time.Millisecond)
+}
+
+// negotiateHeartBeat returns the interval at which the broker will send heart-beats,
+// given the heart-beat header of the CONNECTED frame. 0 means no heart-beats.
+func (p *ConnectionParameters) negotiateHeartBeat(connected string) time.Duration {
+	if p.ServerHeartBeat <= 0 {
+		return 0
+	}
+	parts := strings.Split(connected, ",")
+	if len(parts) != 2 {
+		return 0
+	}
+	serverSend, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil || serverSend <= 0 {
+		return 0
+	}
+	interval := time.Duration(serverSend) * time.Millisecond
+	if interval < p.ServerHeartBeat {
+		interval = p.ServerHeartBeat
+	}
+	return interval
+}
+
+// watchHeartBeats closes the connection if nothing arrives from the broker within the
+// negotiated interval. The reader then fails, and the broker goes through the
+// connection lost path.
+func (c *Broker) watchHeartBeats(conn *livenessConn, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if conn.idle() > heartBeatGrace*interval {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
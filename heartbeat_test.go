@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegotiateHeartBeat(t *testing.T) {
+	tests := []struct {
+		wanted    time.Duration
+		connected string
+		expected  time.Duration
+	}{
+		{0, "1000,1000", 0},
+		{time.Second, "", 0},
+		{time.Second, "0,0", 0},
+		{time.Second, "500,0", time.Second},
+		{time.Second, "2000,0", 2 * time.Second},
+		{time.Second, " 3000 , 0 ", 3 * time.Second},
+		{time.Second, "nope,0", 0},
+		{time.Second, "1000", 0},
+	}
+	for _, test := range tests {
+		params := ConnectionParameters{ServerHeartBeat: test.wanted}
+		if interval := params.negotiateHeartBeat(test.connected); interval != test.expected {
+			t.Errorf("%s with %s: expected %s, got %s", test.connected, test.wanted, test.expected, interval)
+		}
+	}
+}
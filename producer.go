@@ -17,51 +17,223 @@
 package stomp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gmallard/stompngo"
-	"syscall"
+	"sync"
+	"sync/atomic"
 )
 
 type (
-	// Producer models a message producer. Only needs a single connection.;
+	// Producer models a message producer. It sends through a single connection, or
+	// through all the brokers behind the alias if params.Balancing is set.
+	// It is safe for concurrent use.
 	Producer struct {
-		broker *Broker
+		params ConnectionParameters
+		events chan Event
+		// Stops the background retries of unreachable brokers
+		cancel context.CancelFunc
+		// Round-robin counter
+		next uint32
+		// Sends in progress, waited for by Shutdown
+		sending sync.WaitGroup
+
+		// mu protects brokers and closed
+		mu sync.RWMutex
+		// Replaced, never modified, when an unreachable broker comes up
+		brokers []*producerBroker
+		closed  bool
+	}
+
+	// producerBroker is one of the brokers a producer sends through
+	producerBroker struct {
+		// Sends in progress. First, so it is aligned for atomic access.
+		inflight int64
+		broker   *Broker
 	}
 
-	// SendParams holds additional submission parameters that apply to the message
+	// SendParams holds additional submission parameters that apply to the message.
+	// If Headers has a receipt, or ConnectionParameters.Receipts is set, Send waits for
+	// the broker to confirm the message.
 	SendParams struct {
 		Persistent  bool
 		ContentType string
-		Headers map[string]string
+		Headers     map[string]string
 	}
+
+	// Balancing selects how a producer spreads the messages between the brokers
+	// behind an alias
+	Balancing int
 )
 
-// NewProducer instantiates a new producer and initiates the remote connection
+const (
+	// BalanceNone sends through a single connection to the address, without resolving
+	// it first, so custom Dialers and proxies get the name
+	BalanceNone = Balancing(iota)
+	// BalanceRoundRobin connects to all brokers, and sends to each one in turn
+	BalanceRoundRobin
+	// BalanceLeastInflight connects to all brokers, and sends to the one with the
+	// fewest sends in progress
+	BalanceLeastInflight
+)
+
+// String implements fmt.Stringer
+func (b Balancing) String() string {
+	switch b {
+	case BalanceNone:
+		return "none"
+	case BalanceRoundRobin:
+		return "round-robin"
+	case BalanceLeastInflight:
+		return "least-inflight"
+	}
+	return "unknown"
+}
+
+// ParseBalancing parses the string representation of a Balancing
+func ParseBalancing(s string) (Balancing, error) {
+	switch s {
+	case "none", "":
+		return BalanceNone, nil
+	case "round-robin":
+		return BalanceRoundRobin, nil
+	case "least-inflight":
+		return BalanceLeastInflight, nil
+	}
+	return BalanceNone, fmt.Errorf("stomp: invalid balancing %s", s)
+}
+
+// NewProducer instantiates a new producer and initiates the remote connection.
+// If params.Address is an SRV record, the targets are tried by priority and weight.
 func NewProducer(params ConnectionParameters) (*Producer, error) {
-	var err error
+	return NewProducerContext(context.Background(), params)
+}
+
+// NewProducerContext instantiates a new producer and initiates the remote connection,
+// giving up if ctx is done before the connection is established.
+// When balancing, params.MinBrokers applies as for consumers.
+func NewProducerContext(ctx context.Context, params ConnectionParameters) (*Producer, error) {
+	err := params.loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	// A producer sharing the client id of a durable consumer would be rejected
+	params.Durable = false
+	p := &Producer{
+		events: make(chan Event, eventBufferSize),
+	}
+	params.events = p.events
+	p.params = params
 
-	if params.EnableTLS {
-		params.caCertPool = loadRootCAs(params.CaPath, params.CaCert)
-		params.clientCerts, err = loadClientCert(params.UserCert, params.UserKey)
+	if params.Balancing == BalanceNone || isFailover(params.Address) || isWebSocket(params.Address) {
+		// The alias is only resolved here when balancing, so a custom Dialer or a proxy
+		// can still resolve it themselves
+		broker, err := dial(ctx, params)
 		if err != nil {
 			return nil, err
 		}
+		p.brokers = []*producerBroker{{broker: broker}}
+		return p, nil
+	}
+
+	targets, err := resolveTargets(ctx, &params)
+	if err != nil {
+		return nil, err
+	} else if len(targets) == 0 {
+		return nil, errors.New("stomp: no endpoints to connect to")
 	}
+	brokers, errs := dialTargets(ctx, params, targets)
 
-	p := &Producer{}
-	if p.broker, err = dial(params); err != nil {
+	for i, broker := range brokers {
+		if broker != nil {
+			p.brokers = append(p.brokers, &producerBroker{broker: broker})
+		} else if err == nil {
+			err = errs[i]
+		}
+	}
+	if len(p.brokers) < params.requiredBrokers(len(targets)) || ctx.Err() != nil {
+		for _, b := range p.brokers {
+			b.broker.close()
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
 		return nil, err
 	}
+
+	var retryCtx context.Context
+	retryCtx, p.cancel = context.WithCancel(context.Background())
+	for i := range targets {
+		if errs[i] != nil {
+			notify(p.events, EventUnreachable, targets[i].endpoints[0].address, errs[i])
+			go p.retryUnreachable(retryCtx, targets[i])
+		}
+	}
 	return p, nil
 }
 
-// Close finishes the connection and frees resources
+// retryUnreachable connects to t in the background, and starts sending through it
+// once it succeeds
+func (p *Producer) retryUnreachable(ctx context.Context, t target) {
+	broker, err := retryTarget(ctx, p.params, t, func(error) {})
+	if err != nil {
+		if ctx.Err() == nil {
+			notify(p.events, EventGaveUp, t.endpoints[0].address, err)
+		}
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		broker.close()
+		return
+	}
+	brokers := make([]*producerBroker, len(p.brokers), len(p.brokers)+1)
+	copy(brokers, p.brokers)
+	p.brokers = append(brokers, &producerBroker{broker: broker})
+}
+
+// Events returns a channel where the state changes of the connections are published.
+// Publishing never blocks, so events are dropped if the channel is not drained.
+func (p *Producer) Events() <-chan Event {
+	return p.events
+}
+
+// Close finishes the connections and frees resources, without waiting for the sends
+// in progress. See Shutdown.
 func (p *Producer) Close() error {
-	return p.broker.close()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+	brokers := p.brokers
+	p.mu.Unlock()
+
+	var err error
+	for _, b := range brokers {
+		if closeErr := b.broker.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 // Send a message to the broker
-func (p *Producer) Send(destination, message string, params SendParams) (err error) {
+func (p *Producer) Send(destination, message string, params SendParams) error {
+	return p.SendContext(context.Background(), destination, message, params)
+}
+
+// SendContext sends a message to the broker, giving up if ctx is done before the message
+// could be sent (i.e. while reconnecting)
+func (p *Producer) SendContext(ctx context.Context, destination, message string, params SendParams) error {
 	if destination == "" {
 		return stompngo.EREQDSTSND
 	}
@@ -82,10 +254,87 @@ func (p *Producer) Send(destination, message string, params SendParams) (err err
 		}
 	}
 
+	receipt := p.params.Receipts || headers.Value("receipt") != ""
+	return p.send(ctx, func(broker *Broker, conn *stompngo.Connection) error {
+		if receipt {
+			return broker.withReceipt(ctx, conn, headers, func(headers stompngo.Headers) error {
+				return conn.Send(headers, message)
+			})
+		}
+		return conn.Send(headers, message)
+	})
+}
+
+// send runs op on one of the brokers. If its connection is lost, it is recovered in the
+// background while the others are tried. If none is available, send waits for the
+// recovery of one of them.
+func (p *Producer) send(ctx context.Context, op func(*Broker, *stompngo.Connection) error) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrNotConnected
+	}
+	brokers := p.brokers
+	p.sending.Add(1)
+	p.mu.RUnlock()
+	defer p.sending.Done()
+	if len(brokers) == 1 {
+		return brokers[0].run(ctx, op)
+	}
+
+	tried := make(map[*producerBroker]bool, len(brokers))
 	for {
-		if err = p.broker.handleReconnectOnSend(p.broker.stompConnection.Send(headers, message)); err != syscall.EAGAIN {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b := p.pick(brokers, tried)
+		if b == nil {
 			break
 		}
+		tried[b] = true
+
+		conn, gen := b.broker.current()
+		atomic.AddInt64(&b.inflight, 1)
+		err := op(b.broker, conn)
+		atomic.AddInt64(&b.inflight, -1)
+		if err == nil || !isConnectionLost(err) {
+			return err
+		}
+		if b.broker.canReconnect() {
+			go b.broker.connectionLost(b.broker.ctx, gen, err)
+		}
+	}
+
+	b := brokers[atomic.AddUint32(&p.next, 1)%uint32(len(brokers))]
+	return b.run(ctx, op)
+}
+
+// pick returns the broker to send through, skipping the ones already tried and the
+// ones not available. Returns nil if there is none.
+func (p *Producer) pick(brokers []*producerBroker, tried map[*producerBroker]bool) *producerBroker {
+	n := uint32(len(brokers))
+	start := atomic.AddUint32(&p.next, 1)
+	var best *producerBroker
+	for i := uint32(0); i < n; i++ {
+		b := brokers[(start+i)%n]
+		if tried[b] || !b.broker.available() {
+			continue
+		}
+		if p.params.Balancing != BalanceLeastInflight {
+			return b
+		}
+		if best == nil || atomic.LoadInt64(&b.inflight) < atomic.LoadInt64(&best.inflight) {
+			best = b
+		}
 	}
-	return
+	return best
+}
+
+// run runs op on the broker, waiting for the connection to be recovered if lost
+func (b *producerBroker) run(ctx context.Context, op func(*Broker, *stompngo.Connection) error) error {
+	atomic.AddInt64(&b.inflight, 1)
+	defer atomic.AddInt64(&b.inflight, -1)
+	return b.broker.retry(ctx, func(conn *stompngo.Connection) error {
+		return op(b.broker, conn)
+	})
 }
@@ -0,0 +1,310 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ProxyDirect disables the use of a proxy, even if set in the environment
+const ProxyDirect = "direct"
+
+// proxyEnvironment are the environment variables checked for a proxy, in order
+var proxyEnvironment = []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"}
+
+// proxyDialer tunnels connections through a SOCKS5 or HTTP CONNECT proxy
+type proxyDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+// proxyFor returns the proxy to use to reach address, or nil if the connection is direct
+func (p *ConnectionParameters) proxyFor(address string) (*url.URL, error) {
+	raw := p.Proxy
+	if raw == ProxyDirect {
+		return nil, nil
+	}
+	if raw == "" {
+		for _, env := range proxyEnvironment {
+			if raw = os.Getenv(env); raw != "" {
+				break
+			}
+		}
+		if raw == "" || bypassProxy(address) {
+			return nil, nil
+		}
+	}
+
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("stomp: invalid proxy URL: %s", err)
+	}
+	switch proxy.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("stomp: unsupported proxy scheme %s", proxy.Scheme)
+	}
+	if proxy.Port() == "" {
+		switch proxy.Scheme {
+		case "socks5", "socks5h":
+			proxy.Host = net.JoinHostPort(proxy.Hostname(), "1080")
+		case "http":
+			proxy.Host = net.JoinHostPort(proxy.Hostname(), "80")
+		case "https":
+			proxy.Host = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+	}
+	return proxy, nil
+}
+
+// bypassProxy returns true if NO_PROXY says address must be reached directly
+func bypassProxy(address string) bool {
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryHost, _, err := net.SplitHostPort(entry); err == nil {
+			entry = entryHost
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext implements Dialer
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+	}
+
+	tunnel := conn
+	err = handshake(ctx, conn, func() (err error) {
+		switch d.proxy.Scheme {
+		case "socks5", "socks5h":
+			err = socks5Connect(conn, d.proxy.User, address)
+		default:
+			tunnel, err = httpConnect(conn, d.proxy.User, address)
+		}
+		return
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("stomp: proxy %s: %s", d.proxy.Host, err)
+	}
+	return tunnel, nil
+}
+
+// SOCKS5 protocol values, see RFC 1928 and RFC 1929
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5UserPassword = 0x02
+	socks5NoAcceptable = 0xff
+	socks5CmdConnect   = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+)
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect to address
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	// Negotiate authentication
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = append(methods, socks5UserPassword)
+	}
+	if _, err = conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPassword:
+		if user == nil {
+			return errors.New("SOCKS5 proxy requires authentication")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		auth := []byte{0x01, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable SOCKS5 authentication method")
+	default:
+		return fmt.Errorf("unexpected SOCKS5 authentication method %d", reply[1])
+	}
+
+	// Request the connection
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		request = append(request, socks5Domain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5IPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5IPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 connect failed with code %d", header[1])
+	}
+
+	// Discard the bound address
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unexpected SOCKS5 address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// bufferedConn is a net.Conn that first returns whatever was buffered while reading
+// the proxy response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implements net.Conn
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn to open a tunnel to address
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	// The body is not closed, since that would try to drain the tunnel
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP CONNECT failed: %s", response.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// socks5StandIn plays the proxy side of a SOCKS5 handshake on conn. If user is set,
+// it requires those credentials. It replies to the connection request with code.
+func socks5StandIn(t *testing.T, conn net.Conn, user *url.Userinfo, code byte) <-chan []byte {
+	requests := make(chan []byte, 1)
+	go func() {
+		defer close(requests)
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			t.Error(err)
+			return
+		}
+		methods := make([]byte, greeting[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if user == nil {
+			conn.Write([]byte{socks5Version, socks5NoAuth})
+		} else {
+			if !bytes.Contains(methods, []byte{socks5UserPassword}) {
+				conn.Write([]byte{socks5Version, socks5NoAcceptable})
+				return
+			}
+			conn.Write([]byte{socks5Version, socks5UserPassword})
+			header := make([]byte, 2)
+			io.ReadFull(conn, header)
+			username := make([]byte, header[1])
+			io.ReadFull(conn, username)
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			password := make([]byte, length[0])
+			io.ReadFull(conn, password)
+			expected, _ := user.Password()
+			if string(username) != user.Username() || string(password) != expected {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		request := make([]byte, 5)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			t.Error(err)
+			return
+		}
+		var rest int
+		switch request[3] {
+		case socks5IPv4:
+			rest = net.IPv4len - 1 + 2
+		case socks5IPv6:
+			rest = net.IPv6len - 1 + 2
+		case socks5Domain:
+			rest = int(request[4]) + 2
+		}
+		tail := make([]byte, rest)
+		io.ReadFull(conn, tail)
+		requests <- append(request, tail...)
+
+		conn.Write([]byte{socks5Version, code, 0x00, socks5IPv4, 127, 0, 0, 1, 0xea, 0x5d})
+	}()
+	return requests
+}
+
+func TestSocks5Connect(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		expected []byte
+	}{
+		{"domain", "broker.example.com:61613", append(append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5Domain, 18}, "broker.example.com"...), 0xf0, 0xad)},
+		{"ipv4", "192.0.2.1:61613", []byte{socks5Version, socks5CmdConnect, 0x00, socks5IPv4, 192, 0, 2, 1, 0xf0, 0xad}},
+		{"ipv6", "[2001:db8::1]:61613", append(append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5IPv6}, net.ParseIP("2001:db8::1")...), 0xf0, 0xad)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, proxy := net.Pipe()
+			defer client.Close()
+			defer proxy.Close()
+			requests := socks5StandIn(t, proxy, nil, 0x00)
+
+			if err := socks5Connect(client, nil, test.address); err != nil {
+				t.Fatal(err)
+			}
+			if request := <-requests; !bytes.Equal(request, test.expected) {
+				t.Errorf("expected request %v, got %v", test.expected, request)
+			}
+		})
+	}
+}
+
+func TestSocks5ConnectAuthentication(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	defer proxy.Close()
+	socks5StandIn(t, proxy, url.UserPassword("user", "secret"), 0x00)
+
+	if err := socks5Connect(client, url.UserPassword("user", "secret"), "broker:61613"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocks5ConnectFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		proxy  *url.Userinfo
+		client *url.Userinfo
+		code   byte
+	}{
+		{"no credentials", url.UserPassword("user", "secret"), nil, 0x00},
+		{"wrong credentials", url.UserPassword("user", "secret"), url.UserPassword("user", "wrong"), 0x00},
+		{"connection refused", nil, nil, 0x05},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, proxy := net.Pipe()
+			defer client.Close()
+			defer proxy.Close()
+			socks5StandIn(t, proxy, test.proxy, test.code)
+
+			if err := socks5Connect(client, test.client, "broker:61613"); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+// httpStandIn plays the proxy side of an HTTP CONNECT on conn, answering with status.
+// Anything in extra is sent right after the response, as if it came through the tunnel.
+func httpStandIn(t *testing.T, conn net.Conn, status int, extra string) <-chan *http.Request {
+	requests := make(chan *http.Request, 1)
+	go func() {
+		defer close(requests)
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- request
+		response := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		var buffer bytes.Buffer
+		response.Write(&buffer)
+		buffer.WriteString(extra)
+		conn.Write(buffer.Bytes())
+	}()
+	return requests
+}
+
+func TestHTTPConnect(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	defer proxy.Close()
+	requests := httpStandIn(t, proxy, http.StatusOK, "CONNECTED\n")
+
+	tunnel, err := httpConnect(client, url.UserPassword("user", "secret"), "broker:61613")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := <-requests
+	if request.Method != http.MethodConnect || request.Host != "broker:61613" {
+		t.Errorf("unexpected request %s %s", request.Method, request.Host)
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if auth := request.Header.Get("Proxy-Authorization"); auth != expected {
+		t.Errorf("expected authorization %q, got %q", expected, auth)
+	}
+
+	// Whatever arrived with the response belongs to the tunnel
+	line, err := bufio.NewReader(tunnel).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "CONNECTED\n" {
+		t.Errorf("expected the buffered data, got %q", line)
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	defer proxy.Close()
+	httpStandIn(t, proxy, http.StatusProxyAuthRequired, "")
+
+	if _, err := httpConnect(client, nil, "broker:61613"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestHTTPConnectListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		httpStandIn(t, conn, http.StatusOK, "")
+	}()
+
+	proxy := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+	dialer := &proxyDialer{proxy: proxy, forward: &net.Dialer{}}
+	conn, err := dialer.DialContext(context.Background(), "tcp", "broker:61613")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestBypassProxy(t *testing.T) {
+	t.Setenv("NO_PROXY", "localhost, .cern.ch, 10.0.0.0/8, other.example.com:61613")
+	t.Setenv("no_proxy", "")
+
+	tests := []struct {
+		address string
+		bypass  bool
+	}{
+		{"localhost:61613", true},
+		{"broker.cern.ch:61613", true},
+		{"cern.ch:61613", true},
+		{"notcern.ch:61613", false},
+		{"10.1.2.3:61613", true},
+		{"192.0.2.1:61613", false},
+		{"other.example.com:61613", true},
+		{"example.com:61613", false},
+	}
+	for _, test := range tests {
+		if bypass := bypassProxy(test.address); bypass != test.bypass {
+			t.Errorf("%s: expected %t, got %t", test.address, test.bypass, bypass)
+		}
+	}
+}
+
+func TestBypassProxyWildcard(t *testing.T) {
+	t.Setenv("NO_PROXY", "*")
+	if !bypassProxy("broker.example.com:61613") {
+		t.Error("expected * to bypass everything")
+	}
+}
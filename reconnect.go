@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+type (
+	// ReconnectPolicy configures how a Broker reconnects after losing its connection.
+	// The delay between attempts starts at InitialDelay and is multiplied by Multiplier
+	// after each failure, up to MaxDelay. Jitter randomizes each delay by up to that
+	// fraction (i.e. 0.2 means +/- 20%)
+	ReconnectPolicy struct {
+		InitialDelay time.Duration
+		Multiplier   float64
+		MaxDelay     time.Duration
+		Jitter       float64
+		// Give up after this many failed attempts. 0 means no limit
+		MaxAttempts int
+		// Give up once this much time has passed since the connection was lost.
+		// 0 means no limit
+		Deadline time.Duration
+	}
+)
+
+var (
+	// DefaultReconnectPolicy is a sensible policy that retries forever
+	DefaultReconnectPolicy = ReconnectPolicy{
+		InitialDelay: 1 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     1 * time.Minute,
+		Jitter:       0.2,
+	}
+
+	// ErrReconnectGaveUp is returned when the reconnect policy has been exhausted,
+	// wrapped in ErrConnectionLost
+	ErrReconnectGaveUp = errors.New("stomp: gave up reconnecting")
+)
+
+// delay returns how long to wait before the given attempt (starting at 0)
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay)
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	for i := 0; i < attempt; i++ {
+		d *= multiplier
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			d = float64(p.MaxDelay)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// run calls attempt, waiting the policy delay before each call, until it succeeds.
+// If attempt fails with an error for which permanent returns true, that error is returned.
+// If the policy is exhausted, the last error is returned wrapped in ErrReconnectGaveUp.
+// If ctx is done first, ctx.Err() is returned.
+func (p *ReconnectPolicy) run(ctx context.Context, attempt func() error, permanent func(error) bool) error {
+	start := time.Now()
+
+	var err error
+	for n := 0; p.MaxAttempts <= 0 || n < p.MaxAttempts; n++ {
+		wait := p.delay(n)
+		if p.Deadline > 0 && time.Since(start)+wait > p.Deadline {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err = attempt(); err == nil {
+			return nil
+		} else if permanent != nil && permanent(err) {
+			return err
+		}
+	}
+	return wrapError(ErrReconnectGaveUp, err)
+}
+
+// reconnectWithPolicy calls Reconnect until it succeeds, the policy is exhausted,
+// the broker is closed, or ctx is done
+func (c *Broker) reconnectWithPolicy(ctx context.Context) error {
+	var last error
+	err := c.params.ReconnectPolicy.run(ctx, func() error {
+		c.emit(EventReconnecting, last)
+		last = c.ReconnectContext(ctx)
+		return last
+	}, func(err error) bool {
+		// Closed meanwhile
+		return errors.Is(err, ErrNotConnected)
+	})
+	if err == nil || !errors.Is(err, ErrReconnectGaveUp) {
+		return err
+	}
+
+	c.emit(EventGaveUp, err)
+	return wrapError(ErrConnectionLost, err)
+}
+
+// connectionLost is called when the connection with generation gen is detected as gone,
+// because of cause. Only one recovery runs at a time: concurrent callers wait for it,
+// and callers that see an old generation return immediately, since somebody else
+// already reconnected.
+// If there is a reconnect policy, it is applied, and the callback only used as a notification.
+// Otherwise, the callback is expected to reconnect.
+// Returns nil if the caller can retry.
+func (c *Broker) connectionLost(ctx context.Context, gen uint64, cause error) error {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return ErrNotConnected
+		}
+		if c.generation != gen {
+			c.mu.Unlock()
+			return nil
+		}
+		if ongoing := c.recovering; ongoing != nil {
+			c.mu.Unlock()
+			select {
+			case <-ongoing.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			// If the recovery was cancelled by its initiator, try ourselves
+			if ongoing.err == context.Canceled || ongoing.err == context.DeadlineExceeded {
+				continue
+			}
+			return ongoing.err
+		}
+		r := &recovery{done: make(chan struct{})}
+		c.recovering = r
+		c.mu.Unlock()
+
+		r.err = c.recover(ctx, cause)
+
+		c.mu.Lock()
+		c.recovering = nil
+		c.mu.Unlock()
+		close(r.done)
+		return r.err
+	}
+}
+
+// recover notifies the lost connection, and reconnects if there is a policy
+func (c *Broker) recover(ctx context.Context, cause error) error {
+	c.emit(EventDisconnected, cause)
+	if c.params.ConnectionLost != nil {
+		c.params.ConnectionLost(c)
+	}
+	if c.params.ReconnectPolicy != nil {
+		return c.reconnectWithPolicy(ctx)
+	}
+	return nil
+}
+
+// canReconnect returns true if there is a way of recovering from a lost connection
+func (c *Broker) canReconnect() bool {
+	return c.params.ReconnectPolicy != nil || c.params.ConnectionLost != nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialDelay: time.Second,
+		Multiplier:   2,
+		MaxDelay:     10 * time.Second,
+	}
+	expected := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second,
+	}
+	for attempt, delay := range expected {
+		if d := policy.delay(attempt); d != delay {
+			t.Errorf("attempt %d: expected %s, got %s", attempt, delay, d)
+		}
+	}
+}
+
+func TestReconnectPolicyDelayConstant(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second}
+	for attempt := 0; attempt < 5; attempt++ {
+		if d := policy.delay(attempt); d != time.Second {
+			t.Errorf("attempt %d: expected 1s, got %s", attempt, d)
+		}
+	}
+}
+
+func TestReconnectPolicyDelayJitter(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		if d := policy.delay(0); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("delay %s out of the jitter range", d)
+		}
+	}
+}
+
+func TestReconnectPolicyRun(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Millisecond, MaxAttempts: 3}
+	failure := errors.New("failure")
+
+	calls := 0
+	err := policy.run(context.Background(), func() error {
+		calls++
+		return failure
+	}, nil)
+	if calls != 3 || !errors.Is(err, ErrReconnectGaveUp) || !errors.Is(err, failure) {
+		t.Errorf("expected to give up after 3 calls with the last error, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = policy.run(context.Background(), func() error {
+		calls++
+		if calls == 2 {
+			return nil
+		}
+		return failure
+	}, nil)
+	if calls != 2 || err != nil {
+		t.Errorf("expected to succeed on the 2nd call, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = policy.run(context.Background(), func() error {
+		calls++
+		return ErrNotConnected
+	}, func(err error) bool {
+		return errors.Is(err, ErrNotConnected)
+	})
+	if calls != 1 || err != ErrNotConnected {
+		t.Errorf("expected to stop on a permanent error, got %d calls and %v", calls, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = policy.run(ctx, func() error { return nil }, nil); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,428 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// removeDrainTimeout is how long a broker gone from the alias is kept, so the messages
+// already delivered from it can be acknowledged
+const removeDrainTimeout = 30 * time.Second
+
+// target is a broker behind the consumer alias, with all the addresses it can be reached at
+type target struct {
+	// Identifies the broker across resolutions
+	key       string
+	endpoints []endpoint
+}
+
+// isSRV returns true if the address is the name of a DNS SRV record
+func isSRV(address string) bool {
+	return strings.HasPrefix(address, "_") && !strings.Contains(address, ":")
+}
+
+// lookupSRV returns one endpoint per target of the SRV record, sorted by priority
+// and randomized by weight
+func lookupSRV(ctx context.Context, name string, tls bool) ([]endpoint, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]endpoint, len(records))
+	for i, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		endpoints[i] = endpoint{
+			address: net.JoinHostPort(target, strconv.Itoa(int(record.Port))),
+			host:    target,
+			vhost:   target,
+			tls:     tls,
+		}
+	}
+	return endpoints, nil
+}
+
+// resolveTargets returns the brokers behind the alias, or one per target if the address
+// is an SRV record. IPs that share the same reverse DNS name are considered the same broker,
+// and reached through a single connection, trying first the preferred address family.
+func resolveTargets(ctx context.Context, params *ConnectionParameters) ([]target, error) {
+	if isSRV(params.Address) {
+		endpoints, err := lookupSRV(ctx, params.Address, params.EnableTLS)
+		if err != nil {
+			return nil, err
+		}
+		targets := make([]target, len(endpoints))
+		for i, ep := range endpoints {
+			targets[i] = target{key: ep.address, endpoints: []endpoint{ep}}
+		}
+		return targets, nil
+	}
+
+	host, port, err := net.SplitHostPort(params.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*target
+	var targetIPs [][]net.IP
+	byKey := make(map[string]int)
+	for _, ip := range ips {
+		name := reverseDNS(ctx, ip)
+		key := name
+		if key == "" {
+			key = ip.IP.String()
+		}
+		i, ok := byKey[key]
+		if !ok {
+			i = len(targets)
+			byKey[key] = i
+			targets = append(targets, &target{key: key})
+			targetIPs = append(targetIPs, nil)
+		}
+		if params.ServerNameMode == ServerNameReverseDNS && !forwardConfirmed(ctx, name, ip) {
+			// Whoever controls the reverse zone could pick any name
+			name = ""
+		}
+		targets[i].endpoints = append(targets[i].endpoints, endpoint{
+			address: net.JoinHostPort(ip.IP.String(), port),
+			host:    serverName(params.ServerNameMode, host, name, ip),
+			vhost:   host,
+			tls:     params.EnableTLS,
+		})
+		targetIPs[i] = append(targetIPs[i], ip.IP)
+	}
+
+	result := make([]target, len(targets))
+	for i, t := range targets {
+		sortByPreference(t.endpoints, targetIPs[i], params.IPPreference)
+		result[i] = *t
+	}
+	return result, nil
+}
+
+// reverseDNS returns the name registered for ip, or an empty string if there is none
+func reverseDNS(ctx context.Context, ip net.IPAddr) string {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.IP.String())
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// forwardConfirmed returns true if name resolves back to ip
+func forwardConfirmed(ctx context.Context, name string, ip net.IPAddr) bool {
+	if name == "" {
+		return false
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, forward := range ips {
+		if forward.IP.Equal(ip.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverName returns the name to verify for the broker at ip, behind alias.
+// name is the reverse DNS name of the ip, if any, and already confirmed to resolve to ip.
+func serverName(mode ServerNameMode, alias, name string, ip net.IPAddr) string {
+	switch mode {
+	case ServerNameReverseDNS:
+		if name != "" {
+			return name
+		}
+		return alias
+	case ServerNameIP:
+		return ip.IP.String()
+	default:
+		return alias
+	}
+}
+
+// dialTarget connects to a single broker behind the alias, through whichever of its
+// addresses answers first
+func dialTarget(ctx context.Context, params ConnectionParameters, t target) (*Broker, error) {
+	params.Address = t.endpoints[0].address
+	broker, err := dialEndpoints(ctx, params, &failover{
+		endpoints:     t.endpoints,
+		fallbackDelay: params.fallbackDelay(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	broker.target = t.key
+	return broker, nil
+}
+
+// requiredBrokers returns how many of the n brokers behind the alias must be reachable
+func (p *ConnectionParameters) requiredBrokers(n int) int {
+	if p.MinBrokers > 0 && p.MinBrokers < n {
+		return p.MinBrokers
+	}
+	return n
+}
+
+// dialTargets connects to all the targets at once, so a broker that does not answer does
+// not delay the others. Returns the brokers and errors, in the order of targets.
+func dialTargets(ctx context.Context, params ConnectionParameters, targets []target) ([]*Broker, []error) {
+	brokers := make([]*Broker, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			brokers[i], errs[i] = dialTarget(ctx, params, targets[i])
+		}(i)
+	}
+	wg.Wait()
+	return brokers, errs
+}
+
+// retryTarget connects to t following the reconnect policy, until it succeeds, the policy
+// is exhausted or ctx is done. failed is called after each failed attempt.
+func retryTarget(ctx context.Context, params ConnectionParameters, t target, failed func(error)) (*Broker, error) {
+	policy := params.ReconnectPolicy
+	if policy == nil {
+		policy = &DefaultReconnectPolicy
+	}
+
+	var broker *Broker
+	err := policy.run(ctx, func() (err error) {
+		if broker, err = dialTarget(ctx, params, t); err != nil {
+			failed(err)
+		}
+		return
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return broker, nil
+}
+
+// watchDNS periodically resolves the alias again, until the consumer is closed
+func (c *Consumer) watchDNS() {
+	ticker := time.NewTicker(c.params.ResolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
+
+// refresh connects to the brokers that appeared behind the alias, subscribing them to all
+// the active subscriptions, and drains and closes the ones that disappeared
+func (c *Consumer) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.params.ResolveInterval)
+	defer cancel()
+
+	targets, err := resolveTargets(ctx, &c.params)
+	if err != nil {
+		// Keep what we have
+		return
+	}
+
+	c.mu.Lock()
+	existing := make(map[string]bool, len(c.brokers))
+	for _, broker := range c.brokers {
+		existing[broker.target] = true
+	}
+	for key, u := range c.unreachable {
+		// Already being retried
+		existing[key] = u.cancel != nil
+	}
+	c.mu.Unlock()
+
+	// Add the new ones first, so subscriptions never run out of brokers
+	wanted := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		wanted[t.key] = true
+		if existing[t.key] {
+			continue
+		}
+		broker, err := dialTarget(ctx, c.params, t)
+		c.mu.Lock()
+		if err == nil {
+			delete(c.unreachable, t.key)
+			c.addBroker(broker)
+		} else if !c.closed {
+			c.retryLater(t, err)
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	var gone []*Broker
+	for _, broker := range c.brokers {
+		if !wanted[broker.target] {
+			gone = append(gone, broker)
+		}
+	}
+	for key, u := range c.unreachable {
+		if !wanted[key] {
+			if u.cancel != nil {
+				u.cancel()
+			}
+			delete(c.unreachable, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, broker := range gone {
+		go c.removeBroker(broker)
+	}
+}
+
+// retryLater keeps trying to connect to a broker that could not be reached, in the
+// background. Must be called with mu held.
+func (c *Consumer) retryLater(t target, err error) {
+	if u := c.unreachable[t.key]; u != nil && u.cancel != nil {
+		u.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &unreachable{target: t, err: err, cancel: cancel}
+	c.unreachable[t.key] = u
+	notify(c.events, EventUnreachable, t.endpoints[0].address, err)
+	go c.retryUnreachable(ctx, u)
+}
+
+// retryUnreachable connects to u in the background, and registers the broker
+// once it succeeds
+func (c *Consumer) retryUnreachable(ctx context.Context, u *unreachable) {
+	broker, err := retryTarget(ctx, c.params, u.target, func(err error) {
+		c.mu.Lock()
+		u.err = err
+		c.mu.Unlock()
+	})
+
+	c.mu.Lock()
+	if c.unreachable[u.target.key] != u || ctx.Err() != nil {
+		// Gone from the alias, or the consumer closed
+		c.mu.Unlock()
+		if broker != nil {
+			broker.close()
+		}
+		return
+	}
+	if err == nil {
+		delete(c.unreachable, u.target.key)
+		c.addBroker(broker)
+		c.mu.Unlock()
+		return
+	}
+	// Left for the next resolution of the alias, if any
+	u.cancel()
+	u.cancel = nil
+	c.mu.Unlock()
+	notify(c.events, EventGaveUp, u.target.endpoints[0].address, err)
+}
+
+// addBroker registers a new broker, and attaches it to all the active subscriptions.
+// Must be called with mu held.
+func (c *Consumer) addBroker(broker *Broker) {
+	if c.closed {
+		broker.close()
+		return
+	}
+
+	brokers := make([]*Broker, len(c.brokers), len(c.brokers)+1)
+	copy(brokers, c.brokers)
+	c.brokers = append(brokers, broker)
+
+	for _, sub := range c.subscriptions {
+		c.attach(sub, broker)
+	}
+}
+
+// removeBroker unregisters the broker and stops its deliveries. Once the messages in
+// flight are acknowledged, or removeDrainTimeout passes, it unsubscribes from all the
+// active subscriptions and closes the connection.
+func (c *Consumer) removeBroker(broker *Broker) {
+	c.mu.Lock()
+	brokers := make([]*Broker, 0, len(c.brokers))
+	for _, b := range c.brokers {
+		if b != broker {
+			brokers = append(brokers, b)
+		}
+	}
+	c.brokers = brokers
+	ids := make([]string, 0, len(c.subscriptions))
+	var trackers []*inflight
+	for id, sub := range c.subscriptions {
+		ids = append(ids, id)
+		if tracker := sub.inflight[broker]; tracker != nil {
+			trackers = append(trackers, tracker)
+		}
+	}
+	c.mu.Unlock()
+
+	broker.drain()
+	timeout := time.NewTimer(removeDrainTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+wait:
+	for pending(trackers) {
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			break wait
+		case <-c.stop:
+			break wait
+		}
+	}
+
+	for _, id := range ids {
+		broker.drop(id)
+	}
+	broker.close()
+
+	c.mu.Lock()
+	for _, sub := range c.subscriptions {
+		delete(sub.inflight, broker)
+	}
+	c.mu.Unlock()
+}
+
+// pending returns true if any of the trackers has messages not acknowledged yet
+func pending(trackers []*inflight) bool {
+	for _, tracker := range trackers {
+		if tracker.pending() > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"github.com/gmallard/stompngo"
+	"github.com/satori/go.uuid"
+)
+
+// brokerSubscription is a subscription registered on a broker. It is replayed after
+// every successful connection, no matter who triggered it.
+type brokerSubscription struct {
+	headers stompngo.Headers
+	// Name of the durable subscription, if any. Its headers depend on the broker dialect.
+	durable string
+	// Frames received for the subscription, across connections. Errors that end the
+	// subscription are sent here too.
+	frames chan delivery
+	// Closed when unsubscribed
+	done chan struct{}
+	// Set before closing done if the broker rejected the subscription
+	err error
+	// Connection the subscription was last sent to. Protected by the broker mu.
+	conn *stompngo.Connection
+}
+
+// delivery is a frame received for a subscription, on the connection with generation gen
+type delivery struct {
+	stompngo.MessageData
+	gen uint64
+}
+
+// subscribe registers a subscription, and sends it to the broker. If durable is not empty,
+// the broker keeps the subscription under that name while disconnected.
+func (c *Broker) subscribe(ctx context.Context, headers stompngo.Headers, durable string) (*brokerSubscription, error) {
+	id := headers.Value("id")
+	sub := &brokerSubscription{
+		headers: headers,
+		durable: durable,
+		frames:  make(chan delivery),
+		done:    make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	if _, exists := c.subscriptions[id]; exists {
+		c.mu.Unlock()
+		return nil, stompngo.EDUPSID
+	}
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]*brokerSubscription)
+	}
+	c.subscriptions[id] = sub
+	c.mu.Unlock()
+
+	err := c.retry(ctx, func(conn *stompngo.Connection) error {
+		return c.replay(ctx, conn, sub)
+	})
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+	return sub, nil
+}
+
+// unsubscribe unregisters the subscription, and tells the broker. If durable is set,
+// the broker removes the durable subscription too.
+func (c *Broker) unsubscribe(ctx context.Context, id string, durable bool) error {
+	c.mu.RLock()
+	sub := c.subscriptions[id]
+	c.mu.RUnlock()
+	if sub == nil || !c.forget(id) {
+		return nil
+	}
+	return c.retry(ctx, func(conn *stompngo.Connection) error {
+		headers := stompngo.Headers{"id", id}
+		if durable && sub.durable != "" {
+			headers = headers.AddHeaders(removeDurableHeaders(c.dialect(conn), sub.durable))
+		}
+		return c.withReceipt(ctx, conn, headers, conn.Unsubscribe)
+	})
+}
+
+// drop unregisters the subscription, and tells the broker if the connection is up,
+// without waiting for a recovery nor for the receipt
+func (c *Broker) drop(id string) {
+	if !c.forget(id) {
+		return
+	}
+	conn, _ := c.current()
+	if d, err := c.dispatcherFor(conn); err == nil {
+		// Nobody waits for it, but an ERROR in response does not reach the other subscriptions
+		receipt := uuid.NewV4().String()
+		d.expect(receipt)
+		conn.Unsubscribe(stompngo.Headers{"id", id, "receipt", receipt})
+	}
+}
+
+// drain stops forwarding messages to the consumer, while keeping the subscriptions,
+// so the messages in flight can still be acknowledged
+func (c *Broker) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.draining:
+	default:
+		close(c.draining)
+	}
+}
+
+// forget unregisters the subscription. Returns false if it was not registered.
+func (c *Broker) forget(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub, ok := c.subscriptions[id]
+	if ok {
+		delete(c.subscriptions, id)
+		close(sub.done)
+	}
+	return ok
+}
+
+// reject unregisters sub because the broker refused it, so it is not replayed again.
+// Whoever waits on sub.done gets err.
+func (c *Broker) reject(sub *brokerSubscription, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := sub.headers.Value("id")
+	if c.subscriptions[id] == sub {
+		delete(c.subscriptions, id)
+		sub.err = err
+		close(sub.done)
+	}
+}
+
+// forgetAll unregisters all the subscriptions. Must be called with mu held.
+func (c *Broker) forgetAll() {
+	for id, sub := range c.subscriptions {
+		delete(c.subscriptions, id)
+		close(sub.done)
+	}
+}
+
+// resubscribe replays all the registered subscriptions on the current connection
+func (c *Broker) resubscribe() {
+	c.mu.RLock()
+	conn := c.stompConnection
+	subscriptions := make([]*brokerSubscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+	c.mu.RUnlock()
+
+	for _, sub := range subscriptions {
+		err := c.replay(c.ctx, conn, sub)
+		var brokerErr *BrokerError
+		if err == nil {
+			c.emit(EventResubscribed, nil)
+		} else if errors.As(err, &brokerErr) {
+			// Replaying it again would only get the connection closed again
+			c.reject(sub, err)
+		} else if isConnectionLost(err) {
+			// Gone already. Whoever notices will recover, and replay them again.
+			return
+		} else {
+			go c.failSubscription(sub, err)
+		}
+	}
+}
+
+// replay sends sub to conn, unless already done, and forwards its frames. It waits for
+// the broker to confirm it, so a rejection comes back as a *BrokerError.
+// Returns ECONBAD if conn is not the current connection.
+func (c *Broker) replay(ctx context.Context, conn *stompngo.Connection, sub *brokerSubscription) error {
+	c.mu.Lock()
+	if sub.conn == conn {
+		c.mu.Unlock()
+		return nil
+	}
+	d, gen := c.dispatcher, c.generation
+	if c.stompConnection != conn || d == nil {
+		c.mu.Unlock()
+		return stompngo.ECONBAD
+	}
+	sub.conn = conn
+	c.mu.Unlock()
+
+	headers := sub.headers
+	if sub.durable != "" {
+		headers = sub.headers.Clone().AddHeaders(durableHeaders(c.dialect(conn), sub.durable))
+	}
+	// Messages may arrive before the receipt, so they are forwarded right away
+	err := c.withReceipt(ctx, conn, headers, func(headers stompngo.Headers) error {
+		in, err := conn.Subscribe(headers)
+		if err == nil {
+			go c.pump(sub, in, gen, d)
+		}
+		return err
+	})
+	if err != nil {
+		c.mu.Lock()
+		if sub.conn == conn {
+			sub.conn = nil
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// pump forwards the frames of sub received on the connection with generation gen, until
+// that connection is gone or sub is unregistered
+func (c *Broker) pump(sub *brokerSubscription, in <-chan stompngo.MessageData, gen uint64, d *dispatcher) {
+	for {
+		var frame stompngo.MessageData
+		var ok bool
+		select {
+		case frame, ok = <-in:
+		case <-sub.done:
+			return
+		case <-d.done:
+			return
+		}
+
+		if !ok {
+			return
+		} else if frame.Error != nil {
+			if isConnectionLost(frame.Error) {
+				c.recoverInBackground(gen, frame.Error)
+			} else {
+				c.failSubscription(sub, frame.Error)
+			}
+			return
+		}
+
+		select {
+		case sub.frames <- delivery{frame, gen}:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// recoverInBackground starts the recovery of the lost connection with generation gen.
+// If it can not be recovered, the subscriptions get the error.
+func (c *Broker) recoverInBackground(gen uint64, cause error) {
+	if !c.canReconnect() {
+		c.failSubscriptions(lostConnectionError(cause))
+		return
+	}
+	go func() {
+		if err := c.connectionLost(c.ctx, gen, cause); err != nil {
+			c.failSubscriptions(err)
+		}
+	}()
+}
+
+// failSubscriptions sends err to all the registered subscriptions
+func (c *Broker) failSubscriptions(err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, sub := range c.subscriptions {
+		go c.failSubscription(sub, err)
+	}
+}
+
+// failSubscription sends err to sub, unless it is unregistered first
+func (c *Broker) failSubscription(sub *brokerSubscription, err error) {
+	select {
+	case sub.frames <- delivery{MessageData: stompngo.MessageData{Error: err}}:
+	case <-sub.done:
+	}
+}
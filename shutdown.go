@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"github.com/gmallard/stompngo"
+	"github.com/satori/go.uuid"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval is how often Shutdown checks if the messages in flight are done
+const drainPollInterval = 100 * time.Millisecond
+
+// inflight counts the messages of a subscription, from one broker, that have been
+// delivered and not acknowledged yet
+type inflight struct {
+	count int64
+	// Acknowledging a message acknowledges the previous ones too
+	cumulative bool
+}
+
+// add counts a message delivered
+func (f *inflight) add() {
+	if f != nil {
+		atomic.AddInt64(&f.count, 1)
+	}
+}
+
+// done counts a message as finished. If acked, and acknowledgements are cumulative,
+// all the previous ones are finished too.
+func (f *inflight) done(acked bool) {
+	if f == nil {
+		return
+	}
+	if acked && f.cumulative {
+		atomic.StoreInt64(&f.count, 0)
+	} else if atomic.AddInt64(&f.count, -1) < 0 {
+		atomic.StoreInt64(&f.count, 0)
+	}
+}
+
+// pending returns the number of messages not acknowledged yet
+func (f *inflight) pending() int64 {
+	return atomic.LoadInt64(&f.count)
+}
+
+// Shutdown stops the deliveries, waits for the application to consume and acknowledge
+// the messages already delivered, and disconnects from each broker waiting for the
+// DISCONNECT receipt. If ctx is done first, the connections are closed right away,
+// and ctx.Err() returned.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	brokers, subscriptions, ok := c.markClosed()
+	if !ok {
+		return nil
+	}
+
+	// Stop the deliveries, but keep the subscriptions on the brokers, which would
+	// otherwise reject the acknowledgements of the messages in flight
+	for _, sub := range subscriptions {
+		close(sub.stopped)
+	}
+	err := c.drain(ctx, subscriptions)
+
+	// Only now the brokers can stop sending. Each one gets an UNSUBSCRIBE.
+	for _, sub := range subscriptions {
+		for _, broker := range brokers {
+			broker.drop(sub.id)
+		}
+	}
+
+	for _, broker := range brokers {
+		if shutdownErr := broker.shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// drain waits until the subscriptions have been consumed, and their messages acknowledged
+func (c *Consumer) drain(ctx context.Context, subscriptions []*Subscription) error {
+	for _, sub := range subscriptions {
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for !c.drained(subscriptions) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// drained returns true if there are no messages left to consume or acknowledge
+func (c *Consumer) drained(subscriptions []*Subscription) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sub := range subscriptions {
+		if len(sub.out) > 0 {
+			return false
+		}
+		for _, tracker := range sub.inflight {
+			if tracker.pending() > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Shutdown stops accepting messages, waits for the sends in progress, and disconnects
+// from each broker waiting for the DISCONNECT receipt, so the messages sent are known
+// to have reached the broker. If ctx is done first, the connections are closed right away,
+// and ctx.Err() returned.
+func (p *Producer) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+	brokers := p.brokers
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.sending.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, b := range brokers {
+		if shutdownErr := b.broker.shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// shutdown sends DISCONNECT with a receipt, and waits for it before closing the connection,
+// unless ctx is done first
+func (c *Broker) shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.cancel()
+	c.stopHeartBeats()
+	// The receipt is read by stompngo itself
+	c.stopDispatcher()
+	c.forgetAll()
+	netConnection, stompConnection := c.netConnection, c.stompConnection
+	c.mu.Unlock()
+
+	err := handshake(ctx, netConnection, func() error {
+		return stompConnection.Disconnect(stompngo.Headers{"receipt", uuid.NewV4().String()})
+	})
+	if err == nil {
+		receipt := stompConnection.DisconnectReceipt
+		if receipt.Error != nil {
+			err = receipt.Error
+		} else if receipt.Message.Command == stompngo.ERROR {
+			err = newBrokerError(&receipt.Message)
+		}
+	}
+	netConnection.Close()
+
+	c.emit(EventDisconnected, nil)
+	return err
+}
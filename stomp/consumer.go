@@ -17,11 +17,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/satori/go.uuid"
 	"github.com/spf13/cobra"
 	"gitlab.cern.ch/flutter/stomp"
+	"os"
+	"os/signal"
+)
+
+var (
+	selector      string
+	prefetch      int
+	durableName   string
+	removeDurable bool
 )
 
 var ConsumerCmd = &cobra.Command{
@@ -37,26 +46,72 @@ var ConsumerCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 		defer consumer.Close()
+		for address, err := range consumer.Unreachable() {
+			log.Warn("Could not connect to ", address, ": ", err)
+		}
 
-		messages, errors, err := consumer.Subscribe(args[0], uuid.NewV4().String(), stomp.AckAuto)
+		subscription, err := consumer.Subscribe(args[0], stomp.SubscribeParams{
+			ID:       durableName,
+			Selector: selector,
+			Prefetch: prefetch,
+			Durable:  durableName,
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
+		messages, errors := subscription.Messages(), subscription.Errors()
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		shutdown := make(chan struct{})
 
 		log.Info("Subcribed to ", args[0])
 		for {
 			select {
-			case msg := <-messages:
+			case <-interrupt:
+				// Keep consuming while the messages in flight are drained
+				log.Info("Shutting down")
+				go func() {
+					ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+					defer cancel()
+					if removeDurable {
+						if err := subscription.UnsubscribeDurableContext(ctx); err != nil {
+							log.Warn(err)
+						}
+					}
+					if err := consumer.Shutdown(ctx); err != nil {
+						log.Warn(err)
+					}
+					close(shutdown)
+				}()
+			case <-shutdown:
+				log.Debugf("%+v", subscription.Stats())
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					messages = nil
+					continue
+				}
 				log.Print(msg.Headers)
 				log.Print(string(msg.Body))
 				log.Print("")
-			case err = <-errors:
+			case err, ok := <-errors:
+				if !ok {
+					errors = nil
+					continue
+				}
 				log.Error(err)
+			case event := <-consumer.Events():
+				log.Debug(event.Type, " ", event.Address)
 			}
 		}
 	},
 }
 
 func init() {
+	ConsumerCmd.Flags().StringVar(&selector, "selector", "", "Only consume the messages matching this JMS selector")
+	ConsumerCmd.Flags().IntVar(&prefetch, "prefetch", 0, "Maximum number of messages not acknowledged yet sent by the broker")
+	ConsumerCmd.Flags().StringVar(&durableName, "durable", "", "Name of a durable subscription, needs a stable --client-id")
+	ConsumerCmd.Flags().BoolVar(&removeDurable, "remove-durable", false, "Remove the durable subscription from the brokers when interrupted")
 	RootCmd.AddCommand(ConsumerCmd)
 }
@@ -24,9 +24,18 @@ import (
 	"time"
 )
 
+// shutdownTimeout is how long the commands wait for a graceful shutdown
+const shutdownTimeout = 10 * time.Second
+
 var (
 	debug            bool
 	reconnectAttemps int
+	reconnectPolicy  = stomp.DefaultReconnectPolicy
+	connectURL       string
+	serverNameMode   string
+	balancing        string
+	preferIPv4       bool
+	dialect          string
 	params           stomp.ConnectionParameters
 )
 
@@ -35,6 +44,44 @@ var RootCmd = &cobra.Command{
 		if debug {
 			log.SetLevel(log.DebugLevel)
 		}
+		var err error
+		if params.ServerNameMode, err = stomp.ParseServerNameMode(serverNameMode); err != nil {
+			log.Fatal(err)
+		}
+		if params.Balancing, err = stomp.ParseBalancing(balancing); err != nil {
+			log.Fatal(err)
+		}
+		if preferIPv4 {
+			params.IPPreference = stomp.PreferIPv4
+		}
+		if params.Dialect, err = stomp.ParseDialect(dialect); err != nil {
+			log.Fatal(err)
+		}
+		if connectURL != "" {
+			parsed, err := stomp.ParseURL(connectURL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			parsed.ConnectionLost = params.ConnectionLost
+			parsed.ReconnectPolicy = params.ReconnectPolicy
+			parsed.ClientHeartBeat = params.ClientHeartBeat
+			parsed.ServerHeartBeat = params.ServerHeartBeat
+			parsed.ResolveInterval = params.ResolveInterval
+			if parsed.ClientID == "" {
+				parsed.ClientID = params.ClientID
+			}
+			if parsed.Dialect == stomp.DialectAuto {
+				parsed.Dialect = params.Dialect
+			}
+			params = parsed
+		}
+		if durableName != "" {
+			params.Durable = true
+		}
+		if params.ClientID == "" && !params.Durable {
+			params.ClientID = uuid.NewV4().String()
+		}
+		log.Debug("Using ", params)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Usage()
@@ -44,24 +91,36 @@ var RootCmd = &cobra.Command{
 func init() {
 	params.ConnectionLost = func(c *stomp.Broker) {
 		log.Warn("Connection lost, reconnecting: ", c.RemoteAddr())
-		time.Sleep(1 * time.Second)
-		if err := c.Reconnect(); err != nil {
-			log.Fatal(err)
-		}
 		reconnectAttemps++
 	}
-	params.ClientID = uuid.NewV4().String()
+	params.ReconnectPolicy = &reconnectPolicy
 
 	RootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Debug output")
-	RootCmd.PersistentFlags().StringVar(&params.Address, "connect", "localhost:61613", "Stomp host:port")
+	RootCmd.PersistentFlags().StringVar(&params.Address, "connect", "localhost:61613", "Stomp host:port, WebSocket URL, or failover URI")
+	RootCmd.PersistentFlags().StringVar(&connectURL, "url", "", "Connection URL, overrides the individual connection flags")
+	RootCmd.PersistentFlags().StringVar(&params.VirtualHost, "vhost", "", "Stomp virtual host")
+	RootCmd.PersistentFlags().StringVar(&params.Proxy, "proxy", "", "Proxy URL (socks5://, http://), defaults to ALL_PROXY or HTTPS_PROXY")
 	RootCmd.PersistentFlags().StringVar(&params.Login, "login", "fts", "Stomp login name")
 	RootCmd.PersistentFlags().StringVar(&params.Passcode, "passcode", "fts", "Stomp passcode")
 	RootCmd.PersistentFlags().BoolVar(&params.EnableTLS, "tls", false, "Enable TLS")
 	RootCmd.PersistentFlags().BoolVar(&params.Insecure, "insecure", false, "Do not validate remote certificate")
+	RootCmd.PersistentFlags().StringVar(&serverNameMode, "server-name", "alias", "Name to verify on the broker certificates: alias, reverse or ip")
 	RootCmd.PersistentFlags().StringVar(&params.CaPath, "capath", "/etc/grid-security/certificates", "CA Path")
 	RootCmd.PersistentFlags().StringVar(&params.CaCert, "cacert", "", "CA Bundle")
 	RootCmd.PersistentFlags().StringVar(&params.UserCert, "cert", "", "User certificate")
 	RootCmd.PersistentFlags().StringVar(&params.UserKey, "key", "", "User private key")
+	RootCmd.PersistentFlags().DurationVar(&params.ClientHeartBeat, "heart-beat-send", 0, "Interval between client heart-beats")
+	RootCmd.PersistentFlags().DurationVar(&params.ServerHeartBeat, "heart-beat-receive", 0, "Expected interval between broker heart-beats")
+	RootCmd.PersistentFlags().DurationVar(&params.ResolveInterval, "resolve-interval", 0, "Interval between DNS resolutions of the consumer alias")
+	RootCmd.PersistentFlags().IntVar(&params.MinBrokers, "min-brokers", 0, "Brokers behind the alias that must be reachable to start consuming (0 for all)")
+	RootCmd.PersistentFlags().StringVar(&balancing, "balance", "none", "How the producer spreads messages between brokers: none, round-robin or least-inflight")
+	RootCmd.PersistentFlags().BoolVar(&preferIPv4, "prefer-ipv4", false, "Try IPv4 before IPv6 on dual-stack brokers")
+	RootCmd.PersistentFlags().DurationVar(&params.FallbackDelay, "fallback-delay", 0, "Head start of the preferred address family (0 for the default, negative to disable)")
+	RootCmd.PersistentFlags().StringVar(&params.ClientID, "client-id", "", "Client id, random if empty")
+	RootCmd.PersistentFlags().StringVar(&dialect, "dialect", "auto", "Broker flavour for durable subscriptions: auto, activemq, artemis or rabbitmq")
+	RootCmd.PersistentFlags().BoolVar(&params.Receipts, "receipts", false, "Wait for the broker to confirm each message sent or acknowledged")
+	RootCmd.PersistentFlags().IntVar(&reconnectPolicy.MaxAttempts, "reconnect-attempts", 0, "Maximum reconnect attempts (0 for unlimited)")
+	RootCmd.PersistentFlags().DurationVar(&reconnectPolicy.MaxDelay, "reconnect-max-delay", reconnectPolicy.MaxDelay, "Maximum delay between reconnect attempts")
 }
 
 func main() {
@@ -18,12 +18,13 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gitlab.cern.ch/flutter/stomp"
 	"os"
-	"reflect"
 )
 
 var ProducerCmd = &cobra.Command{
@@ -49,9 +50,19 @@ var ProducerCmd = &cobra.Command{
 		}
 
 		if err = producer.Send(args[0], text, stomp.SendParams{Persistent: true}); err != nil {
-			log.Panic(reflect.TypeOf(err))
+			var brokerErr *stomp.BrokerError
+			if errors.As(err, &brokerErr) {
+				log.WithField("headers", brokerErr.Headers).Fatal(brokerErr)
+			}
+			log.Fatal(err)
 		}
 		log.Info("Sent")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err = producer.Shutdown(ctx); err != nil {
+			log.Warn(err)
+		}
 	},
 }
 
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"github.com/gmallard/stompngo"
+	"sync/atomic"
+)
+
+type (
+	// Subscription is a subscription of a Consumer, shared by all its brokers.
+	// Its channels are closed, and its goroutines stopped, once unsubscribed or once
+	// the consumer is closed.
+	Subscription struct {
+		// Counters, for Stats. First, so they are aligned for atomic access.
+		delivered, acked, nacked, errors, errorsDropped uint64
+
+		consumer *Consumer
+		ctx      context.Context
+		cancel   context.CancelFunc
+		id       string
+		headers  stompngo.Headers
+		durable  string
+		out      chan Message
+		errs     chan error
+		// Closed, with the channels, once no broker is left
+		done chan struct{}
+		// Closed by Shutdown to stop forwarding, while the brokers keep the subscription
+		// so the messages in flight can be acknowledged
+		stopped chan struct{}
+
+		// Protected by the consumer mu
+		// Number of brokers delivering to this subscription
+		active int
+		// By broker, if the messages have to be acknowledged
+		inflight map[*Broker]*inflight
+	}
+
+	// SubscriptionStats are the counters of a subscription
+	SubscriptionStats struct {
+		// Messages delivered to the application
+		Delivered uint64
+		// Messages acknowledged, and not acknowledged
+		Acked, Nacked uint64
+		// Messages delivered but not acknowledged yet
+		Pending int64
+		// Errors sent to the application, and dropped because the channel was full
+		Errors, ErrorsDropped uint64
+		// Brokers delivering to the subscription
+		Brokers int
+	}
+)
+
+// ID returns the subscription id
+func (s *Subscription) ID() string {
+	return s.id
+}
+
+// Destination returns the destination subscribed to
+func (s *Subscription) Destination() string {
+	return s.headers.Value("destination")
+}
+
+// Messages returns the channel where the messages are delivered
+func (s *Subscription) Messages() <-chan Message {
+	return s.out
+}
+
+// Errors returns the channel where the errors of the subscription are sent.
+// Errors are dropped if it is full.
+func (s *Subscription) Errors() <-chan error {
+	return s.errs
+}
+
+// Done returns a channel that is closed once the subscription is over, after the
+// other channels are closed
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Unsubscribe ends the subscription on all brokers, and waits for the deliveries to stop
+func (s *Subscription) Unsubscribe() error {
+	return s.UnsubscribeContext(context.Background())
+}
+
+// UnsubscribeContext ends the subscription on all brokers, and waits for the deliveries
+// to stop, giving up if ctx is done first. Messages already in the channel can still
+// be read.
+func (s *Subscription) UnsubscribeContext(ctx context.Context) error {
+	if s.consumer == nil {
+		return nil
+	}
+	return s.consumer.unsubscribe(ctx, s, false)
+}
+
+// UnsubscribeDurable ends the subscription like Unsubscribe, and removes its durable
+// subscription from the brokers. Returns ErrNotSubscribed if the subscription is over.
+func (s *Subscription) UnsubscribeDurable() error {
+	return s.UnsubscribeDurableContext(context.Background())
+}
+
+// UnsubscribeDurableContext is UnsubscribeDurable, giving up if ctx is done first
+func (s *Subscription) UnsubscribeDurableContext(ctx context.Context) error {
+	if s.consumer == nil {
+		return ErrNotSubscribed
+	}
+	return s.consumer.unsubscribe(ctx, s, true)
+}
+
+// Stats returns the counters of the subscription
+func (s *Subscription) Stats() SubscriptionStats {
+	stats := SubscriptionStats{
+		Delivered:     atomic.LoadUint64(&s.delivered),
+		Acked:         atomic.LoadUint64(&s.acked),
+		Nacked:        atomic.LoadUint64(&s.nacked),
+		Errors:        atomic.LoadUint64(&s.errors),
+		ErrorsDropped: atomic.LoadUint64(&s.errorsDropped),
+	}
+	if s.consumer != nil {
+		s.consumer.mu.Lock()
+		stats.Brokers = s.active
+		for _, tracker := range s.inflight {
+			stats.Pending += tracker.pending()
+		}
+		s.consumer.mu.Unlock()
+	}
+	return stats
+}
+
+// reportError sends err to the application, without blocking
+func (s *Subscription) reportError(err error) {
+	select {
+	case s.errs <- err:
+		atomic.AddUint64(&s.errors, 1)
+	default:
+		atomic.AddUint64(&s.errorsDropped, 1)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) CERN 2016
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stomp
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// webSocketSubprotocols are the STOMP subprotocols offered during the WebSocket handshake
+var webSocketSubprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// isWebSocket returns true if the address is a WebSocket URL
+func isWebSocket(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+// wsConn exposes a WebSocket as a stream, so stompngo can use it as a net.Conn.
+// Each write is sent as a text message, and incoming messages are concatenated.
+type wsConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	writeMu sync.Mutex
+}
+
+// connectWebSocket opens a WebSocket connection to the endpoint. The network connection
+// goes through the same dialer and proxy as raw connections, and uses the same TLS
+// configuration for wss://
+func (c *Broker) connectWebSocket(ctx context.Context, ep endpoint) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer, err := c.dialer(address)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		Subprotocols: webSocketSubprotocols,
+	}
+	if ep.tls {
+		dialer.TLSClientConfig = c.tlsConfig(ep)
+	}
+
+	ws, _, err := dialer.DialContext(ctx, ep.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{ws: ws}, nil
+}
+
+// Read implements net.Conn
+func (w *wsConn) Read(b []byte) (int, error) {
+	for {
+		if w.reader == nil {
+			_, reader, err := w.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			w.reader = reader
+		}
+		n, err := w.reader.Read(b)
+		if err == io.EOF {
+			w.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write implements net.Conn. Bodies that are not valid UTF-8 go in binary messages,
+// since the server would close the connection on an invalid text message.
+func (w *wsConn) Write(b []byte) (int, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	messageType := websocket.TextMessage
+	if !utf8.Valid(b) {
+		messageType = websocket.BinaryMessage
+	}
+	if err := w.ws.WriteMessage(messageType, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn
+func (w *wsConn) Close() error {
+	return w.ws.Close()
+}
+
+// LocalAddr implements net.Conn
+func (w *wsConn) LocalAddr() net.Addr {
+	return w.ws.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (w *wsConn) RemoteAddr() net.Addr {
+	return w.ws.RemoteAddr()
+}
+
+// SetDeadline implements net.Conn
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (w *wsConn) SetReadDeadline(t time.Time) error {
+	return w.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn
+func (w *wsConn) SetWriteDeadline(t time.Time) error {
+	return w.ws.SetWriteDeadline(t)
+}